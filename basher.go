@@ -16,14 +16,20 @@ package testbasher
 
 import (
 	"fmt"
-	"math/rand"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"testing"
+	"text/template"
 
 	"github.com/onsi/ginkgo/v2"
+	"github.com/onsi/ginkgo/v2/types"
+	"golang.org/x/sys/unix"
 )
 
 // defsfilename is the filename of a script file containing definitions for
@@ -31,6 +37,14 @@ import (
 // locations where these scripts have been written to.
 const defsfilename = "basher-defs.sh"
 
+// keepenv is the name of the environment variable which, when set to a true
+// value, keeps all temporary directories.
+const keepenv = "TESTBASHER_KEEP"
+
+// tmpdirenv is the name of the environment variable specifying the default
+// root directory for temporary directories.
+const tmpdirenv = "TESTBASHER_TMPDIR"
+
 // allowednamechars specifies the symbols allowed in shell environment and
 // variable names.
 var allowednamechars = regexp.MustCompile("[^A-Za-z0-9_]+")
@@ -55,34 +69,192 @@ var allowednamechars = regexp.MustCompile("[^A-Za-z0-9_]+")
 //
 // Invalid characters in shell script names, such as “-”, will be replaced by
 // “_” in the name of the corresponding environment variable.
+//
+// By default, these script variables are plain shell variables that are only
+// visible to the scripts sourcing the definitions. Setting Export before adding
+// the first script turns them into exported environment variables instead, so
+// that they are also passed on to any non-bash child processes, such as helper
+// binaries run via “unshare”, “nsenter” or “ip netns exec”.
+//
+// Script names that end up as the same variable name after replacing invalid
+// characters, such as “foo-bar” and “foo_bar”, are rejected, as are names
+// clashing with essential shell variables (such as “PATH” or “IFS”) and bash
+// keywords. To stay clear of any such clashes, set VarPrefix, such as “TB_”,
+// so that script “foo” then becomes “$TB_foo”.
+//
+// The temporary directory is created in TempDir, or otherwise in
+// $TESTBASHER_TMPDIR, if set, falling back to the usual temporary directory,
+// such as “/tmp”. As Basher needs to execute scripts from the temporary
+// directory, it checks that the temporary root directory isn't mounted
+// “noexec”.
+//
+// Setting Lint catches syntax errors in scripts early when adding them, instead
+// of later causing cryptic Decode errors when the scripts are run. Findings are
+// reported with their line numbers mapped back to where the scripts originate
+// from, such as the Go source code adding a script. As scripts may reference
+// scripts, files and variables added later, referencing variables that aren't
+// assigned is only checked when starting a script.
+//
+// Before starting a script, Basher checks all scripts for calling scripts via
+// variables that don't reference any known script, such as “$usrns” instead of
+// “$userns”. Such misspelled variables expand to empty strings, so the scripts
+// would otherwise execute something unexpected. Basher also checks for scripts
+// calling each other in cycles. See RefCheck for details.
 type Basher struct {
-	tmpdir   string            // temporary directory receiving scripts.
-	defspath string            // path/filename to script with definitions, in temporary dir.
-	scripts  map[string]string // maps script names to their temporary files.
+	// Export the script variables to child processes; this must be set before
+	// adding any scripts.
+	Export bool
+	// VarPrefix is prepended to the names of all script variables; this must
+	// be set before adding any scripts.
+	VarPrefix string
+	// Lint all scripts as soon as they are added, using “bash -n” as well as
+	// “shellcheck”, if installed; this must be set before adding any scripts.
+	Lint bool
+	// RefCheck controls how to react to scripts calling undefined scripts, or
+	// scripts calling each other in cycles; it defaults to RefCheckWarn.
+	RefCheck RefCheck
+	// T optionally is the test of a non-Ginkgo test, so Done can tell whether
+	// the test has failed.
+	T testing.TB
+	// TempDir is the root directory in which to create the temporary
+	// directory for the scripts. It defaults to $TESTBASHER_TMPDIR, and
+	// otherwise to the usual temporary directory, such as /tmp.
+	TempDir string
+	// TempPrefix overrides the name prefix of the temporary directory, which
+	// otherwise is derived from the current spec's source location or from
+	// T's name.
+	TempPrefix string
+
+	tmpdir   string             // temporary directory receiving scripts.
+	defspath string             // path/filename to script with definitions, in temporary dir.
+	scripts  map[string]*script // maps script names to their temporary files.
+	vars     map[string]string  // maps variable names to their owners.
+	env      []string           // exported "name=value" definitions.
+	defs     []string           // definitions in the definitions script.
+	commons  []*common          // common scripts in the order they were added.
+	commonno int                // number of the most recently added unnamed common script.
+	deferred bool               // keeping or removing tmpdir is left to a Ginkgo cleanup node.
+	finished map[string]bool    // temporary directories already kept or removed.
+	warned   map[string]bool    // warnings already given.
+}
+
+// script describes a script added to a Basher.
+type script struct {
+	path   string             // temporary script file.
+	body   string             // script body, without header.
+	origin location           // where the script body originates from, for error reporting.
+	tmpl   *template.Template // template still to be rendered into the body, if any.
+	data   interface{}        // data for rendering the template.
+
+	lintvarrefs bool // still to be checked for referencing unassigned variables.
 }
 
 // Done cleans up all temporary scripts and preferably is to be defer'ed by a
 // test case immediately after creating a Basher.
+//
+// For post-mortem debugging, Done keeps the temporary scripts and fixtures if
+// the current Ginkgo spec (or T, if set) has failed, or if the environment
+// variable “TESTBASHER_KEEP” is set to a true value, such as “1”. The path of
+// the kept temporary directory is then written to the GinkgoWriter (or logged
+// to T), so it shows up in the failure output. Kept temporary directories are
+// never removed by RemoveStale.
+//
+// As a Ginkgo spec counts as failed only after its failed assertion has been
+// fully unwound, Done leaves the decision to keep or remove the temporary
+// directory of a Basher used inside a spec to a cleanup node run at the end of
+// the spec; see also ginkgo.DeferCleanup. This cleanup node also removes the
+// temporary directory in case Done never gets called.
 func (b *Basher) Done() {
-	if b.tmpdir != "" {
-		// All we need to do is call remove all ;) This neatly removes the
-		// temporary script directory with all its scripts.
-		if err := os.RemoveAll(b.tmpdir); err != nil {
-			panic(err.Error())
-		}
-		b.tmpdir = ""
+	if b.tmpdir == "" {
+		return
+	}
+	if b.keep() || !b.deferred {
+		b.finish(b.tmpdir)
+	}
+	b.tmpdir = ""
+}
+
+// finish keeps the specified temporary directory for post-mortem debugging,
+// if necessary, and otherwise removes it. Directories already finished are
+// left alone.
+func (b *Basher) finish(dir string) {
+	if b.finished[dir] {
+		return
+	}
+	if b.finished == nil {
+		b.finished = map[string]bool{}
+	}
+	b.finished[dir] = true
+	if b.keep() {
+		b.logf("Basher: keeping temporary directory %s", dir)
+		markKept(dir)
+		return
+	}
+	// All we need to do is call remove all ;) This neatly removes the
+	// temporary script directory with all its scripts.
+	if err := os.RemoveAll(dir); err != nil {
+		panic(err.Error())
 	}
 }
 
+// keep returns true if the temporary directory should be kept for post-mortem
+// debugging.
+func (b *Basher) keep() bool {
+	if keep, _ := strconv.ParseBool(os.Getenv(keepenv)); keep {
+		return true
+	}
+	if b.T != nil {
+		return b.T.Failed()
+	}
+	return ginkgo.CurrentSpecReport().Failed()
+}
+
+// logf logs the formatted message to T, if set, and otherwise writes it to the
+// GinkgoWriter.
+func (b *Basher) logf(format string, args ...interface{}) {
+	if b.T != nil {
+		b.T.Logf(format, args...)
+		return
+	}
+	fmt.Fprintf(ginkgo.GinkgoWriter, format+"\n", args...)
+}
+
 // Start starts the named script as a new TestCommand, with the given
-// arguments.
+// arguments. If the Basher exports its script variables, then these are also
+// put into the environment of the started script, so that even programs that
+// never source the definitions receive them.
 func (b *Basher) Start(name string, args ...string) *TestCommand {
+	return newTestCommand(b.command(name, args), b.logTo, b.shareScripts)
+}
+
+// StartWith starts the named script as a new TestCommand, with the given
+// arguments and start options. Apart from the options, StartWith behaves
+// exactly like Start.
+func (b *Basher) StartWith(name string, args []string, opts ...StartOption) *TestCommand {
+	return newTestCommand(b.command(name, args), append(opts[:len(opts):len(opts)], b.logTo, b.shareScripts)...)
+}
+
+// command returns the (not yet started) command for running the named script
+// with the given arguments, after checking the scripts.
+func (b *Basher) command(name string, args []string) *exec.Cmd {
 	name = strings.TrimSuffix(name, ".sh")
-	scriptpath, ok := b.scripts[name]
+	s, ok := b.scripts[name]
 	if !ok {
 		panic(fmt.Sprintf("cannot run unknown script %q", name))
 	}
-	return NewTestCommand(scriptpath, args...)
+	b.renderTemplates()
+	if b.Lint {
+		b.lintVarRefs()
+	}
+	if err := b.checkCommons(); err != nil {
+		panic(fmt.Errorf("Basher: cannot run script %q, reason: %v", name, err))
+	}
+	b.checkRefs(name)
+	c := exec.Command(s.path, args...)
+	if len(b.env) > 0 {
+		c.Env = append(os.Environ(), b.env...)
+	}
+	return c
 }
 
 // Script adds a (BASH) script with the given name. The script will
@@ -95,113 +267,222 @@ func (b *Basher) Start(name string, args ...string) *TestCommand {
 // variable “$foo” pointing to its temporary location. A script “foo-bar” has
 // the associated environment variable “$foo_bar”.
 func (b *Basher) Script(name, script string) {
-	b.init("")
-	b.addScript(name, script, false)
-}
-
-// Common adds an unnamed script with common definitions, which are then
-// automatically made available to all (non-common) scripts.
-func (b *Basher) Common(script string) {
-	b.init("")
-	b.addScript(fmt.Sprintf("common%d", rand.Int()), script, true)
+	b.init()
+	b.addScript(name, script, caller(1))
 }
 
 // addScript creates a temporary script file from the given script, and adds
-// it to the known scripts as "name". If this is a "common" script, then it
-// will automatically be sourced in all non-common scripts.
-func (b *Basher) addScript(name, script string, common bool) {
+// it to the known scripts as "name". The origin tells where the script came
+// from, such as a Go source code location or a script file.
+func (b *Basher) addScript(name, body string, origin location) {
 	// Cut off any .sh suffix, if present. Then assign a full path to the
 	// script, located in the temporary script directory.
 	name = strings.TrimSuffix(name, ".sh")
-	if _, ok := b.scripts[name]; ok {
-		panic(fmt.Errorf("Basher: duplicate script name %q", name))
+	if other, ok := b.scripts[name]; ok {
+		panic(fmt.Errorf("Basher: duplicate script name %q from %s, already defined by %s",
+			name, origin, other.origin))
 	}
-	scriptpath := filepath.Join(b.tmpdir, name+".sh")
-	b.scripts[name] = scriptpath
 	// Set a new environment variable to the full path and script name
 	// (including .sh) of the script. However, the name of the environment
-	// variable itself will be sans any .sh suffix.
-	envname := allowednamechars.ReplaceAllString(name, "_")
-	f, err := os.OpenFile(b.defspath, os.O_APPEND|os.O_WRONLY, 0744)
-	if err != nil {
-		panic(fmt.Errorf(
-			"Basher: cannot augment common definitions script %q, reason: %v",
-			b.defspath, err))
-	}
-	defer f.Close()
-	if !common {
-		if _, err := f.WriteString(fmt.Sprintf("%s=%q\n", envname, scriptpath)); err != nil {
-			panic(fmt.Errorf(
-				"Basher: cannot augment common definitions script %q, reason: %v",
-				b.defspath, err))
-		}
-	} else {
-		if _, err := f.WriteString(fmt.Sprintf(". %q\n", scriptpath)); err != nil {
-			panic(fmt.Errorf(
-				"Basher: cannot augment common definitions script %q, reason: %v",
-				b.defspath, err))
-		}
-	}
+	// variable itself will be sans any .sh suffix. Make sure that the variable
+	// doesn't clash with another script's variable after sanitizing, nor with
+	// any essential shell variables.
+	envname := b.VarPrefix + allowednamechars.ReplaceAllString(name, "_")
+	b.claimVar(envname, fmt.Sprintf("script %q", name))
+	scriptpath := filepath.Join(b.tmpdir, name+".sh")
+	b.scripts[name] = &script{path: scriptpath, body: body, origin: origin, lintvarrefs: b.Lint}
+	b.definePath(envname, scriptpath)
 	// Create a new (executable) script file with the given name in the
 	// temporary directory. We automatically prefix the script with a BASH
 	// shebang and source the script alias definition so the script can be
 	// called by their registered names but point to the correct temporary
 	// location they were written to.
-	f, err = os.OpenFile(scriptpath, os.O_WRONLY|os.O_CREATE, 0744)
+	writeScript(name, scriptpath, ". "+shellquote(b.defspath)+"\n"+body, os.O_EXCL)
+	if b.Lint {
+		b.lint(fmt.Sprintf("script %q", name), scriptpath, 2, origin)
+	}
+}
+
+// writeScript writes the (executable) script with the specified body to the
+// specified path, automatically adding a BASH shebang. The flags are
+// additional file open flags, such as os.O_EXCL to never overwrite an
+// existing file, or os.O_TRUNC to overwrite an existing script.
+func writeScript(name, scriptpath, body string, flags int) {
+	f, err := os.OpenFile(scriptpath, os.O_WRONLY|os.O_CREATE|flags, 0744)
 	if err != nil {
 		panic(fmt.Errorf(
 			"Basher: cannot create temporary %q script as %q, reason: %v",
 			name, scriptpath, err))
 	}
 	defer f.Close()
-	header := "#!/bin/bash\n"
-	if !common {
-		header += ". " + b.defspath + "\n"
+	body = "#!/bin/bash\n" + body
+	if !strings.HasSuffix(body, "\n") {
+		body += "\n"
 	}
-	script = header + script
-	if !strings.HasSuffix(script, "\n") {
-		script += "\n"
-	}
-	if _, err = f.WriteString(script); err != nil {
+	if _, err = f.WriteString(body); err != nil {
 		panic(fmt.Errorf(
 			"Basher: cannot create temporary %q script as %q, reason: %v",
 			name, scriptpath, err))
 	}
 }
 
+// claimVar claims the named shell variable for the specified owner, panicking
+// if the variable name is invalid, reserved, or already claimed.
+func (b *Basher) claimVar(varname, owner string) {
+	if err := checkVarname(varname); err != nil {
+		panic(fmt.Errorf("Basher: invalid variable for %s, reason: %v", owner, err))
+	}
+	if other, ok := b.vars[varname]; ok {
+		panic(fmt.Errorf("Basher: %s clashes with %s on variable %q",
+			owner, other, varname))
+	}
+	b.vars[varname] = owner
+}
+
+// definePath defines the variable with the specified name to point to the
+// specified path, exporting the variable if requested.
+func (b *Basher) definePath(varname, path string) {
+	def := varname + "=" + shellquote(path)
+	if b.Export {
+		def = "export " + def
+		b.env = append(b.env, varname+"="+path)
+	}
+	b.appendDefs(def)
+}
+
+// appendDefs appends the specified definition line to the definitions script
+// sourced by all auxiliary scripts.
+func (b *Basher) appendDefs(def string) {
+	b.defs = append(b.defs, def)
+	b.writeDefs()
+}
+
+// writeDefs (re)writes the definitions script sourced by all auxiliary
+// scripts, consisting of the variable definitions, followed by sourcing the
+// common scripts in their proper order.
+func (b *Basher) writeDefs() {
+	commons, err := b.orderedCommons()
+	if err != nil {
+		panic(fmt.Errorf("Basher: %v", err))
+	}
+	var defs strings.Builder
+	defs.WriteString("#!/bin/bash\n")
+	for _, def := range b.defs {
+		defs.WriteString(def + "\n")
+	}
+	for _, c := range commons {
+		defs.WriteString(c.sourcing(b))
+	}
+	if err := os.WriteFile(b.defspath, []byte(defs.String()), 0744); err != nil {
+		panic(fmt.Errorf(
+			"Basher: cannot write %q with common definitions, reason: %v",
+			b.defspath, err))
+	}
+	if b.Lint {
+		b.lint("definitions", b.defspath, 0, location{})
+	}
+}
+
 // init initializes a Basher if it hasn't been initialized so far. Thus, init
 // can be called multiple times without causing damage.
-func (b *Basher) init(tmp string) {
+func (b *Basher) init() {
 	if b.tmpdir != "" {
 		return // already initialized, so we're done already.
 	}
 	// If this basher hasn't yet been initialized, we first create a temporary
 	// directory with a prefix containing the current test's source code
 	// filename (but without the ".go" file suffix) and a random suffix.
-	currentSpecReport := ginkgo.CurrentSpecReport()
-	prefix := fmt.Sprintf("%s-line-%d-",
-		strings.TrimSuffix(path.Base(currentSpecReport.FileName()), ".go"),
-		currentSpecReport.LineNumber())
-	tmpdir, err := os.MkdirTemp(tmp, prefix)
+	prefix := b.TempPrefix
+	if prefix == "" {
+		if b.T != nil {
+			prefix = allowednamechars.ReplaceAllString(b.T.Name(), "_") + "-"
+		} else {
+			currentSpecReport := ginkgo.CurrentSpecReport()
+			prefix = fmt.Sprintf("%s-line-%d-",
+				strings.TrimSuffix(path.Base(currentSpecReport.FileName()), ".go"),
+				currentSpecReport.LineNumber())
+		}
+	}
+	root := b.TempDir
+	if root == "" {
+		root = TempRoot()
+	}
+	if err := checkExecutable(root); err != nil {
+		panic(fmt.Errorf("Basher: unusable temporary root directory, reason: %v", err))
+	}
+	tmpdir, err := os.MkdirTemp(root, prefix)
 	if err != nil {
 		panic(err.Error())
 	}
 	b.tmpdir = tmpdir
-	b.scripts = make(map[string]string)
+	b.writeOwner()
+	// Inside a Ginkgo spec, the spec's outcome is known only at its end, so
+	// we need to leave keeping or removing the temporary directory to a
+	// cleanup node.
+	b.deferred = b.T == nil && ginkgo.CurrentSpecReport().LeafNodeType == types.NodeTypeIt
+	if b.deferred {
+		ginkgo.DeferCleanup(b.finish, tmpdir)
+	}
+	b.scripts = make(map[string]*script)
+	b.vars = make(map[string]string)
+	b.env = nil
+	b.defs = nil
+	b.commons = nil
+	b.commonno = 0
+	b.warned = map[string]bool{}
 	// Set up a script file to be sourced by auxiliary scripts, which will
 	// receive common environment variables definitions pointing to the
 	// temporary locations of these aux scripts during a test.
 	b.defspath = filepath.Join(b.tmpdir, defsfilename)
-	f, err := os.OpenFile(b.defspath, os.O_CREATE|os.O_WRONLY, 0744)
-	if err != nil {
-		panic(fmt.Errorf(
-			"Basher: failed to create %q for common definitions, reason: %v",
-			b.defspath, err))
+	b.writeDefs()
+}
+
+// checkExecutable returns an error if the specified temporary root directory
+// (or the default temporary directory if empty) doesn't allow executing
+// scripts stored in it, such as when being mounted "noexec".
+func checkExecutable(root string) error {
+	if root == "" {
+		root = os.TempDir()
 	}
-	defer f.Close()
-	if _, err = f.WriteString("#!/bin/bash\n"); err != nil {
-		panic(fmt.Errorf(
-			"Basher: cannot write %q with common definitions, reason: %v",
-			b.defspath, err))
+	var stat unix.Statfs_t
+	if err := unix.Statfs(root, &stat); err != nil {
+		return fmt.Errorf("cannot determine mount options of %q, reason: %v", root, err)
+	}
+	if stat.Flags&unix.ST_NOEXEC != 0 {
+		return fmt.Errorf("%q is mounted noexec, so scripts cannot be run from it; "+
+			"please set Basher.TempDir or $%s to a different directory", root, tmpdirenv)
+	}
+	return nil
+}
+
+// TempRoot returns the root directory Bashers create their temporary
+// directories in by default: $TESTBASHER_TMPDIR, if set, otherwise the
+// system's temporary directory.
+func TempRoot() string {
+	if root := os.Getenv(tmpdirenv); root != "" {
+		return root
+	}
+	return os.TempDir()
+}
+
+// IsBasherDir returns true if the specified directory is a temporary Basher
+// directory, that is, it contains the definitions script.
+func IsBasherDir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, defsfilename))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// ScriptNames returns the sorted names of the scripts in the specified
+// temporary Basher directory, without the definitions script.
+func ScriptNames(dir string) []string {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.sh"))
+	names := []string{}
+	for _, match := range matches {
+		if filepath.Base(match) == defsfilename {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(filepath.Base(match), ".sh"))
 	}
+	sort.Strings(names)
+	return names
 }
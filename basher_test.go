@@ -15,10 +15,15 @@
 package testbasher
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
 )
 
 var _ = Describe("Basher", func() {
@@ -45,6 +50,58 @@ var _ = Describe("Basher", func() {
 		Expect(b.tmpdir).ToNot(BeAnExistingFile())
 	})
 
+	It("keeps temporary scripts when asked to", func() {
+		os.Setenv("TESTBASHER_KEEP", "1")
+		defer os.Unsetenv("TESTBASHER_KEEP")
+
+		b := Basher{}
+		b.Script("script", "")
+		tmpdir := b.tmpdir
+		defer os.RemoveAll(tmpdir)
+		b.Done()
+		Expect(tmpdir).To(BeADirectory())
+	})
+
+	It("keeps temporary scripts of failed tests", func() {
+		t := &fakeT{failed: true}
+		b := Basher{T: t}
+		b.Script("script", "")
+		tmpdir := b.tmpdir
+		defer os.RemoveAll(tmpdir)
+		b.Done()
+		Expect(tmpdir).To(BeADirectory())
+		Expect(t.logs).To(ConsistOf("Basher: keeping temporary directory " + tmpdir))
+	})
+
+	It("removes temporary scripts only at the end of specs", func() {
+		var tmpdir string
+		DeferCleanup(func() {
+			Expect(tmpdir).NotTo(BeAnExistingFile())
+		})
+		b := Basher{}
+		defer b.Done()
+		b.Script("script", "")
+		tmpdir = b.tmpdir
+		b.Done()
+		Expect(tmpdir).To(BeADirectory())
+	})
+
+	attempt := 0
+	var failedtmpdir string
+	It("keeps temporary scripts of failed specs", FlakeAttempts(2), func() {
+		attempt++
+		if attempt > 1 {
+			defer os.RemoveAll(failedtmpdir)
+			Expect(failedtmpdir).To(BeADirectory())
+			return
+		}
+		b := Basher{}
+		defer b.Done()
+		b.Script("script", "")
+		failedtmpdir = b.tmpdir
+		Fail("failing deliberately in order to keep the temporary scripts")
+	})
+
 	It("includes common scripts", func() {
 		b := Basher{}
 		defer b.Done()
@@ -60,6 +117,25 @@ var _ = Describe("Basher", func() {
 		Expect(s).To(Equal("<42><12345>"))
 	})
 
+	It("exports script variables to child processes", func() {
+		b := Basher{Export: true}
+		defer b.Done()
+
+		b.Script("script", `sh -c 'echo "\"$other\""' && read`)
+		b.Script("other", "")
+		cmd := b.Start("script")
+		defer cmd.Close()
+
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal(filepath.Join(b.tmpdir, "other.sh")))
+
+		environ, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", cmd.cmd.Process.Pid))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.Split(string(environ), "\x00")).To(ContainElement(
+			"other=" + filepath.Join(b.tmpdir, "other.sh")))
+	})
+
 	It("doesn't accept the same script twice", func() {
 		b := Basher{}
 		defer b.Done()
@@ -68,6 +144,36 @@ var _ = Describe("Basher", func() {
 		Expect(func() { b.Script("foo", "") }).To(Panic())
 	})
 
+	It("rejects script names clashing on their variables", func() {
+		b := Basher{}
+		defer b.Done()
+
+		Expect(func() { b.Script("foo-bar", "") }).ToNot(Panic())
+		Expect(func() { b.Script("foo_bar", "") }).To(PanicWith(MatchError(
+			`Basher: script "foo_bar" clashes with script "foo-bar" on variable "foo_bar"`)))
+		Expect(func() { b.Script("PATH", "") }).To(PanicWith(MatchError(
+			MatchRegexp(`"PATH" is a reserved shell variable`))))
+		Expect(func() { b.Script("BASH_ENV", "") }).To(PanicWith(MatchError(
+			MatchRegexp(`"BASH_ENV" is a reserved shell variable`))))
+		Expect(func() { b.Script("done", "") }).To(PanicWith(MatchError(
+			MatchRegexp(`"done" is a bash keyword`))))
+		Expect(func() { b.Script("42", "") }).To(PanicWith(MatchError(
+			MatchRegexp(`"42" is not a valid shell variable name`))))
+	})
+
+	It("prefixes script variables", func() {
+		b := Basher{VarPrefix: "TB_"}
+		defer b.Done()
+
+		b.Script("PATH", `echo "\"$TB_PATH\"" && read`)
+		cmd := b.Start("PATH")
+		defer cmd.Close()
+
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal(filepath.Join(b.tmpdir, "PATH.sh")))
+	})
+
 	It("cannot start an unknown script", func() {
 		b := Basher{}
 		defer b.Done()
@@ -76,8 +182,65 @@ var _ = Describe("Basher", func() {
 	})
 
 	It("panics when the filesystem goes wrong", func() {
+		b := Basher{TempDir: "/nowhere"}
+		Expect(func() { b.init() }).To(Panic())
+	})
+
+	It("uses a custom temporary root directory and prefix", func() {
+		root := GinkgoT().TempDir()
+		os.Setenv("TESTBASHER_TMPDIR", root)
+		defer os.Unsetenv("TESTBASHER_TMPDIR")
+
 		b := Basher{}
-		Expect(func() { b.init("/nowhere") }).To(Panic())
+		defer b.Done()
+		b.Script("script", "")
+		Expect(filepath.Dir(b.tmpdir)).To(Equal(root))
+		Expect(TempRoot()).To(Equal(root))
+
+		b2 := Basher{TempDir: GinkgoT().TempDir(), TempPrefix: "foo-"}
+		defer b2.Done()
+		b2.Script("script", "")
+		Expect(filepath.Dir(b2.tmpdir)).To(Equal(b2.TempDir))
+		Expect(filepath.Base(b2.tmpdir)).To(HavePrefix("foo-"))
+	})
+
+	It("recognizes temporary directories and lists their scripts", func() {
+		b := Basher{TempDir: GinkgoT().TempDir()}
+		defer b.Done()
+		b.Script("foo", "")
+		b.Script("bar", "")
+		Expect(IsBasherDir(b.tmpdir)).To(BeTrue())
+		Expect(IsBasherDir(b.TempDir)).To(BeFalse())
+		Expect(ScriptNames(b.tmpdir)).To(Equal([]string{"bar", "foo"}))
+	})
+
+	It("rejects noexec temporary root directories", func() {
+		if os.Geteuid() != 0 {
+			Skip("needs root")
+		}
+		root := GinkgoT().TempDir()
+		Expect(unix.Mount("tmpfs", root, "tmpfs", unix.MS_NOEXEC, "")).To(Succeed())
+		defer func() { _ = unix.Unmount(root, 0) }()
+
+		b := Basher{TempDir: root}
+		defer b.Done()
+		Expect(func() { b.Script("script", "") }).To(PanicWith(MatchError(MatchRegexp(
+			`^Basher: unusable temporary root directory, reason: ".*" is mounted noexec`))))
 	})
 
 })
+
+// fakeT is a non-Ginkgo test recording its logs.
+type fakeT struct {
+	testing.TB
+	failed bool
+	logs   []string
+}
+
+func (t *fakeT) Failed() bool { return t.failed }
+
+func (t *fakeT) Logf(format string, args ...any) {
+	t.logs = append(t.logs, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeT) Name() string { return "TestFake" }
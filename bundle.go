@@ -0,0 +1,308 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Names of the files added to a reproduction bundle, besides the scripts and
+// fixtures.
+const (
+	// ManifestFilename is the name of the bundle manifest, describing the
+	// original location of the scripts, the entry script, its arguments, and
+	// the transcript of the interaction with the entry script.
+	ManifestFilename = "testbasher.json"
+	// ReplayFilename is the name of the runner script in a bundle, which
+	// replays the recorded input against the scripts.
+	ReplayFilename = "replay.sh"
+	// StdinFilename is the name of the file in a bundle containing the input
+	// sent to the entry script, in order.
+	StdinFilename = "stdin.txt"
+)
+
+// Manifest describes the contents of a reproduction bundle.
+type Manifest struct {
+	Root       string   `json:"root"`                 // original temporary directory.
+	Entry      string   `json:"entry,omitempty"`      // name of entry script.
+	Args       []string `json:"args,omitempty"`       // arguments passed to the entry script.
+	Transcript []Step   `json:"transcript,omitempty"` // interaction with the entry script.
+}
+
+// Bundle writes a self-contained reproduction bundle to w as a gzip'ed
+// tarball, so that failing tests can be reproduced without the Go test. The
+// bundle contains all scripts, definitions and fixtures of this Basher, as
+// well as the arguments used for starting the specified TestCommand and the
+// transcript of the interaction with it. If cmd is nil, then the bundle
+// contains only the scripts, definitions and fixtures. Script templates not
+// yet rendered get rendered first.
+//
+// The bundle contains a single top-level directory, named after the temporary
+// directory of this Basher. Running the “replay.sh” script in this directory
+// runs the entry script with the original arguments, feeding it the recorded
+// input. As Basher scripts reference each other using absolute paths, the
+// runner script first adjusts them to the new bundle location.
+//
+// Please note that Bundle must be called before Done, as otherwise the
+// temporary scripts are gone.
+func (b *Basher) Bundle(w io.Writer, cmd *TestCommand) error {
+	if b.tmpdir == "" {
+		return errors.New("Basher: no temporary scripts to bundle")
+	}
+	// Make sure to bundle rendered scripts, even if nothing has been started
+	// yet.
+	b.renderTemplates()
+	manifest := Manifest{Root: b.tmpdir}
+	if cmd != nil {
+		for name, s := range b.scripts {
+			if s.path == cmd.path {
+				manifest.Entry = name
+				break
+			}
+		}
+		if manifest.Entry == "" {
+			return fmt.Errorf("Basher: command %q isn't a script of this Basher",
+				cmd.path)
+		}
+		manifest.Args = cmd.args
+		manifest.Transcript = cmd.Transcript()
+	}
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	top := filepath.Base(b.tmpdir)
+	// First, bundle all the scripts, definitions and fixtures.
+	err := filepath.WalkDir(b.tmpdir, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil || d.Name() == ownerfilename {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(b.tmpdir, filename)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(top, filepath.ToSlash(rel))
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Basher: cannot bundle %q, reason: %v", b.tmpdir, err)
+	}
+	// Then add the manifest, as well as the replay runner and its input.
+	mjson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Basher: cannot bundle manifest, reason: %v", err)
+	}
+	var stdin strings.Builder
+	for _, step := range manifest.Transcript {
+		switch step.Op {
+		case StepTell:
+			stdin.WriteString(step.Text + "\n")
+		case StepProceed:
+			stdin.WriteString("\n")
+		}
+	}
+	for _, file := range []struct {
+		name    string
+		content string
+		mode    int64
+	}{
+		{name: ManifestFilename, content: string(mjson) + "\n", mode: 0644},
+		{name: StdinFilename, content: stdin.String(), mode: 0644},
+		{name: ReplayFilename, content: replayScript(manifest), mode: 0755},
+	} {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(top, file.name),
+			Size:     int64(len(file.content)),
+			Mode:     file.mode,
+			ModTime:  time.Now(),
+		}); err != nil {
+			return fmt.Errorf("Basher: cannot bundle %q, reason: %v", file.name, err)
+		}
+		if _, err := io.WriteString(tw, file.content); err != nil {
+			return fmt.Errorf("Basher: cannot bundle %q, reason: %v", file.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("Basher: cannot finish bundle, reason: %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return fmt.Errorf("Basher: cannot finish bundle, reason: %v", err)
+	}
+	return nil
+}
+
+// replayScript returns the runner script for replaying the recorded input
+// against the entry script of the specified bundle manifest.
+func replayScript(manifest Manifest) string {
+	var script strings.Builder
+	script.WriteString(`#!/bin/bash
+# Replays the recorded input against the entry script of this testbasher
+# reproduction bundle.
+set -e
+here="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+root=` + shellquote(manifest.Root) + `
+[[ -f "$here/.root" ]] && root="$(<"$here/.root")"
+# Scripts reference each other using absolute paths, so we need to adjust them
+# to wherever this bundle has been unpacked to.
+if [[ "$root" != "$here" ]]; then
+    while IFS= read -r -d '' f; do
+        [[ "$f" == "$here/` + ReplayFilename + `" ]] && continue
+        content="$(<"$f")"
+        printf '%s\n' "${content//"$root"/"$here"}" > "$f"
+    done < <(find "$here" -name '*.sh' -type f -print0)
+    printf '%s' "$here" > "$here/.root"
+fi
+`)
+	if manifest.Entry == "" {
+		script.WriteString("echo \"no entry script recorded\" >&2\nexit 1\n")
+		return script.String()
+	}
+	script.WriteString(`exec "$here/"` + shellquote(manifest.Entry+".sh"))
+	for _, arg := range manifest.Args {
+		script.WriteString(" " + shellquote(arg))
+	}
+	script.WriteString(` < "$here/` + StdinFilename + "\"\n")
+	return script.String()
+}
+
+// ExtractBundle extracts the reproduction bundle read from r into the
+// specified directory, returning the path of the bundle's top-level directory
+// and its manifest. As Basher scripts reference each other using absolute
+// paths, ExtractBundle adjusts them to the location of the extracted bundle,
+// updating the manifest's Root accordingly.
+func ExtractBundle(r io.Reader, dir string) (string, Manifest, error) {
+	var manifest Manifest
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", manifest, fmt.Errorf("invalid bundle, reason: %v", err)
+	}
+	tr := tar.NewReader(gzr)
+	top := ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", manifest, fmt.Errorf("invalid bundle, reason: %v", err)
+		}
+		name := path.Clean(hdr.Name)
+		if !fs.ValidPath(name) {
+			return "", manifest, fmt.Errorf("invalid bundle path %q", hdr.Name)
+		}
+		if t := strings.SplitN(name, "/", 2)[0]; top == "" {
+			top = t
+		} else if t != top {
+			return "", manifest, fmt.Errorf("bundle with multiple top-level directories %q and %q",
+				top, t)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return "", manifest, err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return "", manifest, err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+				fs.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return "", manifest, err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return "", manifest, err
+			}
+		}
+	}
+	if top == "" {
+		return "", manifest, errors.New("empty bundle")
+	}
+	top = filepath.Join(dir, top)
+	mjson, err := os.ReadFile(filepath.Join(top, ManifestFilename))
+	if err != nil {
+		return "", manifest, fmt.Errorf("bundle without manifest, reason: %v", err)
+	}
+	if err := json.Unmarshal(mjson, &manifest); err != nil {
+		return "", manifest, fmt.Errorf("invalid bundle manifest, reason: %v", err)
+	}
+	if err := relocate(top, manifest.Root); err != nil {
+		return "", manifest, err
+	}
+	manifest.Root = top
+	return top, manifest, nil
+}
+
+// relocate adjusts the absolute paths in the scripts in the specified
+// directory from their original root directory to this directory.
+func relocate(dir, root string) error {
+	if root == "" || root == dir {
+		return nil
+	}
+	err := filepath.WalkDir(dir, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(filename) != ".sh" ||
+			filename == filepath.Join(dir, ReplayFilename) {
+			return err
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filename,
+			[]byte(strings.ReplaceAll(string(content), root, dir)), 0)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot relocate bundle scripts, reason: %v", err)
+	}
+	// Let the replay runner script know that we've already relocated the
+	// scripts.
+	return os.WriteFile(filepath.Join(dir, ".root"), []byte(dir), 0644)
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("reproduction bundles", func() {
+
+	It("records transcripts", func() {
+		c := NewTestCommand("/bin/bash", "-c", `read IN && echo "\"${IN}!\"" && read`)
+		c.Tell("foo")
+		var s string
+		c.Decode(&s)
+		c.Close()
+		Expect(c.Transcript()).To(HaveExactElements(
+			Step{Op: StepTell, Text: "foo"},
+			Step{Op: StepDecode, Value: json.RawMessage(`"foo!"`)},
+			Step{Op: StepProceed},
+		))
+	})
+
+	It("bundles and replays", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Common(`GREETING="Hello"`)
+		b.Script("entry", `$echo "$1"`)
+		b.Script("echo", `read IN && echo "\"$GREETING, $1 and ${IN}!\"" && read`)
+		cmd := b.Start("entry", "World")
+		cmd.Tell("Universe")
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal("Hello, World and Universe!"))
+		cmd.Close()
+
+		var bundle bytes.Buffer
+		Expect(b.Bundle(&bundle, cmd)).To(Succeed())
+		tmpdir := b.tmpdir
+		b.Done()
+
+		dir := GinkgoT().TempDir()
+		untar := exec.Command("tar", "xzf", "-", "-C", dir)
+		untar.Stdin = &bundle
+		Expect(untar.Run()).To(Succeed())
+		top := filepath.Join(dir, filepath.Base(tmpdir))
+
+		mjson, err := os.ReadFile(filepath.Join(top, ManifestFilename))
+		Expect(err).NotTo(HaveOccurred())
+		var manifest Manifest
+		Expect(json.Unmarshal(mjson, &manifest)).To(Succeed())
+		Expect(manifest.Root).To(Equal(tmpdir))
+		Expect(manifest.Entry).To(Equal("entry"))
+		Expect(manifest.Args).To(ConsistOf("World"))
+		Expect(manifest.Transcript).To(HaveLen(3))
+
+		out, err := exec.Command(filepath.Join(top, ReplayFilename)).Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("\"Hello, World and Universe!\"\n"))
+		// ...and once more, now that the paths have been adjusted.
+		out, err = exec.Command(filepath.Join(top, ReplayFilename)).Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("\"Hello, World and Universe!\"\n"))
+	})
+
+	It("rejects foreign commands and missing scripts", func() {
+		b := Basher{}
+		var bundle bytes.Buffer
+		Expect(b.Bundle(&bundle, nil)).To(MatchError("Basher: no temporary scripts to bundle"))
+
+		b.Script("script", "")
+		defer b.Done()
+		c := NewTestCommand("/bin/true")
+		defer c.Close()
+		Expect(b.Bundle(&bundle, c)).To(MatchError(
+			`Basher: command "/bin/true" isn't a script of this Basher`))
+	})
+
+	It("extracts and relocates bundles", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Script("entry", `$echo "$1"`)
+		b.Script("echo", `echo "\"$1\""`)
+		cmd := b.Start("entry", "World")
+		var s string
+		cmd.Decode(&s)
+		cmd.Close()
+
+		var bundle bytes.Buffer
+		Expect(b.Bundle(&bundle, cmd)).To(Succeed())
+		b.Done()
+
+		dir := GinkgoT().TempDir()
+		top, manifest, err := ExtractBundle(&bundle, dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Dir(top)).To(Equal(dir))
+		Expect(manifest.Root).To(Equal(top))
+		Expect(manifest.Entry).To(Equal("entry"))
+
+		out, err := exec.Command(filepath.Join(top, "entry.sh"), "World").Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("\"World\"\n"))
+		out, err = exec.Command(filepath.Join(top, ReplayFilename)).Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("\"World\"\n"))
+	})
+
+	It("bundles rendered templates", func() {
+		b := Basher{}
+		defer b.Done()
+		b.Template("script", `echo "\"{{.}}\""`, "foo")
+
+		var bundle bytes.Buffer
+		Expect(b.Bundle(&bundle, nil)).To(Succeed())
+		top, _, err := ExtractBundle(&bundle, GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+		out, err := exec.Command(filepath.Join(top, "script.sh")).Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(Equal("\"foo\"\n"))
+	})
+
+	It("rejects invalid bundles", func() {
+		_, _, err := ExtractBundle(strings.NewReader("foobar"), GinkgoT().TempDir())
+		Expect(err).To(MatchError(HavePrefix("invalid bundle, reason: ")))
+	})
+
+})
@@ -0,0 +1,266 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CgroupConfig configures the cgroup (v2) a TestCommand gets started in; see
+// InCgroup.
+type CgroupConfig struct {
+	// Parent is the directory of the delegated cgroup beneath which to create
+	// the command's cgroup, such as "/sys/fs/cgroup/user.slice/...". If empty,
+	// the cgroup of the test process is used. As controllers cannot be
+	// enabled for child cgroups of a non-root cgroup with processes of its
+	// own (the “no internal processes” rule), limits then cannot be applied,
+	// unless the test process is in the root cgroup. Limits thus usually
+	// need a Parent without any processes.
+	Parent string
+	// MemoryMax limits the memory of the command's cgroup in bytes; zero for
+	// no limit.
+	MemoryMax int64
+	// PidsMax limits the number of processes in the command's cgroup; zero
+	// for no limit.
+	PidsMax int
+	// CPUMax limits the CPU bandwidth of the command's cgroup in the format
+	// of "cpu.max", such as "50000 100000" for half a CPU; empty for no limit.
+	CPUMax string
+}
+
+// InCgroup starts the command in a new cgroup (v2) of its own, created
+// beneath the configured parent cgroup and with the configured resource
+// limits applied. Close then kills all processes in this cgroup, including
+// processes having escaped the process group and session of the command, and
+// finally removes the cgroup.
+//
+// Please note that the memory, pids, and cpu controllers need to be enabled
+// in the “cgroup.subtree_control” of the parent cgroup in order to set the
+// corresponding limits, so the parent cgroup must not have processes of its
+// own; see CgroupConfig.Parent. InCgroup needs Linux 5.7 or later.
+func InCgroup(config CgroupConfig) StartOption {
+	return func(cmd *TestCommand) {
+		cmd.cgroupconfig = &config
+	}
+}
+
+// Cgroup returns the directory of the cgroup the command was started in, or
+// "" if the command wasn't started using InCgroup. After Close, the cgroup
+// doesn't exist anymore.
+func (cmd *TestCommand) Cgroup() string {
+	return cmd.cgroup
+}
+
+// makeCgroup creates the cgroup to start the command in, if configured,
+// applying the configured limits. It returns the open cgroup directory to be
+// closed after the command has been started, or nil if the command isn't to
+// be started in a cgroup of its own.
+func (cmd *TestCommand) makeCgroup() (*os.File, error) {
+	config := cmd.cgroupconfig
+	if config == nil {
+		return nil, nil
+	}
+	parent := config.Parent
+	limited := config.MemoryMax != 0 || config.PidsMax != 0 || config.CPUMax != ""
+	if parent == "" {
+		var err error
+		if parent, err = ownCgroup(); err != nil {
+			return nil, err
+		}
+		if limited && !rootCgroup(parent) {
+			return nil, fmt.Errorf("TestCommand: cannot limit cgroup beneath own cgroup %q, "+
+				"as controllers cannot be enabled for cgroups beneath non-root cgroups with "+
+				"processes; please specify a CgroupConfig.Parent without processes", parent)
+		}
+	}
+	dir, err := os.MkdirTemp(parent, "testbasher-")
+	if err != nil {
+		return nil, fmt.Errorf("TestCommand: cannot create cgroup beneath %q, reason: %w", parent, err)
+	}
+	cmd.cgroup = dir
+	limits := [][2]string{}
+	if config.MemoryMax != 0 {
+		limits = append(limits, [2]string{"memory.max", strconv.FormatInt(config.MemoryMax, 10)})
+	}
+	if config.PidsMax != 0 {
+		limits = append(limits, [2]string{"pids.max", strconv.Itoa(config.PidsMax)})
+	}
+	if config.CPUMax != "" {
+		limits = append(limits, [2]string{"cpu.max", config.CPUMax})
+	}
+	for _, limit := range limits {
+		if err := writeCgroupFile(dir, limit[0], limit[1]); err != nil {
+			_ = os.Remove(dir)
+			hint := ""
+			if errors.Is(err, os.ErrNotExist) {
+				controller, _, _ := strings.Cut(limit[0], ".")
+				hint = fmt.Sprintf(" (the %s controller might not be enabled in %s)",
+					controller, filepath.Join(parent, "cgroup.subtree_control"))
+			}
+			return nil, fmt.Errorf("TestCommand: cannot set %s of cgroup %q, reason: %w%s",
+				limit[0], dir, err, hint)
+		}
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		_ = os.Remove(dir)
+		return nil, fmt.Errorf("TestCommand: cannot open cgroup %q, reason: %w", dir, err)
+	}
+	cmd.cmd.SysProcAttr.UseCgroupFD = true
+	cmd.cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return f, nil
+}
+
+// removeCgroup kills all processes still in the cgroup of the command, if
+// any, and then removes the cgroup, reporting failure to do so as a warning.
+func (cmd *TestCommand) removeCgroup() {
+	if cmd.cgroup == "" {
+		return
+	}
+	members := cgroupProcs(cmd.cgroup)
+	err := killCgroup(cmd.cgroup)
+	if err == nil {
+		// The cgroup might still be busy for a short time after its last
+		// process has gone.
+		for attempt := 1; ; attempt++ {
+			err = os.Remove(cmd.cgroup)
+			if !errors.Is(err, syscall.EBUSY) || attempt == 100 {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	cmd.reap(nil, nil, members)
+	if err != nil {
+		cmd.warnf("TestCommand: warning: cannot remove cgroup %q of %q started at %s, reason: %v",
+			cmd.cgroup, cmd.path, cmd.origin, err)
+	}
+}
+
+// killCgroup kills all processes in the specified cgroup and waits for them
+// to be gone. On kernels before 5.14 lacking “cgroup.kill”, killCgroup
+// instead repeatedly kills the processes listed in the cgroup, in order to
+// catch processes forking in the meantime.
+func killCgroup(dir string) error {
+	usekill := writeCgroupFile(dir, "cgroup.kill", "1") == nil
+	for attempt := 1; ; attempt++ {
+		procs := cgroupProcs(dir)
+		if len(procs) == 0 {
+			return nil
+		}
+		if attempt == 100 {
+			return fmt.Errorf("%d processes still alive", len(procs))
+		}
+		if !usekill {
+			for pid := range procs {
+				_ = unix.Kill(pid, unix.SIGKILL)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// writeCgroupFile writes the specified value to an existing file of the
+// specified cgroup.
+func writeCgroupFile(dir string, name string, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// cgroupProcs returns the PIDs of the processes in the specified cgroup, if
+// any.
+func cgroupProcs(dir string) map[int]bool {
+	if dir == "" {
+		return nil
+	}
+	procs, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	pids := map[int]bool{}
+	for _, field := range strings.Fields(string(procs)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids[pid] = true
+		}
+	}
+	return pids
+}
+
+// rootCgroup returns true if the specified cgroup (v2) directory is the root
+// of its hierarchy, which lacks the “cgroup.type” file of non-root cgroups.
+func rootCgroup(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "cgroup.type"))
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// ownCgroup returns the directory of the cgroup (v2) the test process is a
+// member of.
+func ownCgroup() (string, error) {
+	cgroups, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("TestCommand: cannot determine own cgroup, reason: %w", err)
+	}
+	var path string
+	found := false
+	for _, line := range strings.Split(string(cgroups), "\n") {
+		if path, found = strings.CutPrefix(line, "0::"); found {
+			break
+		}
+	}
+	if !found {
+		return "", errors.New("TestCommand: not a member of a cgroup v2 hierarchy")
+	}
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", fmt.Errorf("TestCommand: cannot determine cgroup v2 mount, reason: %w", err)
+	}
+	defer mountinfo.Close()
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		// See proc(5): the filesystem type follows the "-" separator, and
+		// the mount root and mount point are the fourth and fifth fields.
+		fields := strings.Fields(scanner.Text())
+		sep := 0
+		for sep < len(fields) && fields[sep] != "-" {
+			sep++
+		}
+		if sep < 5 || sep+1 >= len(fields) || fields[sep+1] != "cgroup2" {
+			continue
+		}
+		rel, err := filepath.Rel(fields[3], path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		return filepath.Join(fields[4], rel), nil
+	}
+	return "", errors.New("TestCommand: cgroup v2 hierarchy not mounted")
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// writableCgroup returns the cgroup of the test process, skipping the test
+// if there is no cgroup v2 hierarchy or no permission to create cgroups in
+// it.
+func writableCgroup() string {
+	GinkgoHelper()
+	parent, err := ownCgroup()
+	if err != nil {
+		Skip(err.Error())
+	}
+	dir, err := os.MkdirTemp(parent, "testbasher-")
+	if err != nil {
+		Skip("cannot create cgroups: " + err.Error())
+	}
+	Expect(os.Remove(dir)).To(Succeed())
+	return parent
+}
+
+var _ = Describe("cgroups", func() {
+
+	It("determines its own cgroup", func() {
+		parent, err := ownCgroup()
+		if err != nil {
+			Skip(err.Error())
+		}
+		Expect(filepath.Join(parent, "cgroup.procs")).To(BeARegularFile())
+	})
+
+	It("starts commands in their own cgroups and kills them all", func() {
+		parent := writableCgroup()
+		b := Basher{}
+		defer b.Done()
+		b.Script("script", `
+echo "\"$(sed -n 's/^0:://p' /proc/$$/cgroup)\""
+(setsid sleep 1000 & echo $! > "$1")
+read
+`)
+		pidfile := filepath.Join(GinkgoT().TempDir(), "pid")
+		c := b.StartWith("script", []string{pidfile}, InCgroup(CgroupConfig{}))
+		defer c.Close()
+		Expect(c.Cgroup()).To(HavePrefix(parent + "/testbasher-"))
+		var cgroup string
+		c.Decode(&cgroup)
+		Expect(c.Cgroup()).To(HaveSuffix(cgroup))
+
+		var pid int
+		Eventually(func() error {
+			text, err := os.ReadFile(pidfile)
+			if err == nil {
+				_, err = fmt.Sscan(string(text), &pid)
+			}
+			return err
+		}).Should(Succeed())
+		Expect(cgroupProcs(c.Cgroup())).To(HaveKey(pid))
+
+		c.Close()
+		Expect(c.Leaks()).To(ContainElement(HaveField("PID", pid)))
+		Expect(c.Cgroup()).NotTo(BeADirectory())
+		// Unless we're a child subreaper, the killed process might linger as a
+		// zombie until some init process gets around to reap it.
+		Eventually(func() byte {
+			ps, err := readProcStat(pid)
+			if err != nil {
+				return 'X'
+			}
+			return ps.state
+		}).Should(BeElementOf(byte('X'), byte('Z')))
+	})
+
+	It("applies limits or reports missing controllers", func() {
+		parent := writableCgroup()
+		controllers, err := os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+		Expect(err).NotTo(HaveOccurred())
+		entries, _ := os.ReadDir(parent)
+		before := len(entries)
+
+		b := Basher{}
+		defer b.Done()
+		b.Script("script", `echo "\"$(cat "$(dirname "$0")/../pids.max" 2>/dev/null)\"" && read`)
+		config := CgroupConfig{PidsMax: 42}
+		if !strings.Contains(string(controllers), "pids") {
+			Expect(func() {
+				c := b.StartWith("script", nil, InCgroup(config))
+				c.Close()
+			}).To(PanicWith(MatchRegexp(
+				`^TestCommand: cannot set pids\.max of cgroup ".*", reason: .* \(the pids controller might not be enabled in .*\)$`)))
+			entries, _ = os.ReadDir(parent)
+			Expect(entries).To(HaveLen(before))
+			return
+		}
+		c := b.StartWith("script", nil, InCgroup(config))
+		defer c.Close()
+		pidsmax, err := os.ReadFile(filepath.Join(c.Cgroup(), "pids.max"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.TrimSpace(string(pidsmax))).To(Equal("42"))
+	})
+
+	It("tells root cgroups apart", func() {
+		dir := GinkgoT().TempDir()
+		Expect(rootCgroup(dir)).To(BeTrue())
+		Expect(os.WriteFile(filepath.Join(dir, "cgroup.type"), []byte("domain\n"), 0644)).To(Succeed())
+		Expect(rootCgroup(dir)).To(BeFalse())
+	})
+
+	It("refuses limits beneath its own non-root cgroup", func() {
+		parent, err := ownCgroup()
+		if err != nil {
+			Skip(err.Error())
+		}
+		if rootCgroup(parent) {
+			Skip("test process is in the root cgroup")
+		}
+		Expect(func() {
+			_ = NewTestCommandWith("/bin/true", nil, InCgroup(CgroupConfig{PidsMax: 42}))
+		}).To(PanicWith(And(
+			HavePrefix(`TestCommand: cannot limit cgroup beneath own cgroup`),
+			ContainSubstring("CgroupConfig.Parent"))))
+	})
+
+	It("reports failing to create cgroups", func() {
+		Expect(func() {
+			_ = NewTestCommandWith("/bin/true", nil,
+				InCgroup(CgroupConfig{Parent: "/nonexisting"}))
+		}).To(PanicWith(HavePrefix(`TestCommand: cannot create cgroup beneath "/nonexisting", reason: `)))
+	})
+
+})
@@ -0,0 +1,133 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/thediveo/testbasher"
+)
+
+// list lists the kept Basher temporary directories and reproduction bundles
+// found in the directories specified in args, or in the default temporary
+// root directory, skipping the directories of tests still running. Bundles as
+// well as Basher directories can also be specified directly.
+func list(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flagset("list", stderr)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	roots := fs.Args()
+	if len(roots) == 0 {
+		roots = []string{testbasher.TempRoot()}
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	status := 0
+	for _, root := range roots {
+		info, err := os.Stat(root)
+		if err != nil {
+			fmt.Fprintf(stderr, "testbasher: %v\n", err)
+			status = 1
+			continue
+		}
+		if !info.IsDir() || testbasher.IsBasherDir(root) {
+			if !listEntry(w, root, info.IsDir()) {
+				fmt.Fprintf(stderr, "testbasher: %q is neither a Basher directory nor a bundle\n", root)
+				status = 1
+			}
+			continue
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			fmt.Fprintf(stderr, "testbasher: %v\n", err)
+			status = 1
+			continue
+		}
+		for _, entry := range entries {
+			p := filepath.Join(root, entry.Name())
+			if entry.IsDir() && !testbasher.IsKept(p) {
+				continue
+			}
+			listEntry(w, p, entry.IsDir())
+		}
+	}
+	return status
+}
+
+// listEntry lists the specified Basher directory or bundle, returning false if
+// it is neither.
+func listEntry(w io.Writer, p string, isdir bool) bool {
+	if isdir {
+		if !testbasher.IsBasherDir(p) {
+			return false
+		}
+		fmt.Fprintf(w, "directory\t%s\t%s\n", p, strings.Join(testbasher.ScriptNames(p), " "))
+		return true
+	}
+	if !strings.HasSuffix(p, ".tar.gz") && !strings.HasSuffix(p, ".tgz") {
+		return false
+	}
+	manifest, err := readManifest(p)
+	if err != nil {
+		return false
+	}
+	what := manifest.Entry
+	for _, arg := range manifest.Args {
+		what += " " + arg
+	}
+	fmt.Fprintf(w, "bundle\t%s\t%s\n", p, what)
+	return true
+}
+
+// readManifest returns the manifest of the specified bundle, without
+// extracting the bundle.
+func readManifest(bundle string) (testbasher.Manifest, error) {
+	var manifest testbasher.Manifest
+	f, err := os.Open(bundle)
+	if err != nil {
+		return manifest, err
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return manifest, err
+	}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("bundle without manifest")
+			}
+			return manifest, err
+		}
+		name := path.Clean(hdr.Name)
+		if path.Base(name) == testbasher.ManifestFilename && path.Dir(path.Dir(name)) == "." {
+			err := json.NewDecoder(tr).Decode(&manifest)
+			return manifest, err
+		}
+	}
+}
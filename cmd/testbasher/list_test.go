@@ -0,0 +1,69 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/thediveo/testbasher"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("listing", func() {
+
+	It("lists Basher directories and bundles", func() {
+		root := GinkgoT().TempDir()
+		running := testbasher.Basher{TempDir: root, TempPrefix: "running-"}
+		defer running.Done()
+		running.Script("running", "echo running")
+
+		b := testbasher.Basher{TempDir: root, TempPrefix: "kept-"}
+		defer b.Done()
+		b.Script("foo", "echo foo")
+		b.Script("bar", "echo bar")
+		cmd := b.Start("foo", "baz")
+		cmd.Close()
+		f, err := os.Create(filepath.Join(root, "repro.tar.gz"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.Bundle(f, cmd)).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(root, "other"), 0755)).To(Succeed())
+		GinkgoT().Setenv("TESTBASHER_KEEP", "1")
+		b.Done()
+
+		var stdout, stderr bytes.Buffer
+		Expect(run([]string{"list", root}, nil, &stdout, &stderr)).To(Equal(0))
+		Expect(stderr.String()).To(BeEmpty())
+		lines := bytes.Split(bytes.TrimSpace(stdout.Bytes()), []byte("\n"))
+		Expect(lines).To(HaveLen(2))
+		Expect(string(lines[0])).To(MatchRegexp(`^directory\s+` + root + `/kept-\S+\s+bar foo$`))
+		Expect(string(lines[1])).To(MatchRegexp(`^bundle\s+` + root + `/repro.tar.gz\s+foo baz$`))
+	})
+
+	It("rejects what it cannot list", func() {
+		var stdout, stderr bytes.Buffer
+		Expect(run([]string{"list", "/nowhere"}, nil, &stdout, &stderr)).To(Equal(1))
+		Expect(stderr.String()).To(ContainSubstring("/nowhere"))
+
+		stderr.Reset()
+		Expect(run([]string{"list", "list.go"}, nil, &stdout, &stderr)).To(Equal(1))
+		Expect(stderr.String()).To(ContainSubstring("neither a Basher directory nor a bundle"))
+	})
+
+})
@@ -0,0 +1,83 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Command testbasher helps debugging test harness scripts without having to
+// rebuild and rerun the test binary. It lists the temporary script
+// directories kept by Basher for failed tests, as well as reproduction
+// bundles, and replays the recorded interaction with an entry script,
+// pretty-printing the JSON stream it outputs.
+//
+// Usage:
+//
+//	testbasher list [dir|bundle ...]
+//	testbasher replay [-stdin] [-timeout d] [-keep] dir|bundle [entry [arg ...]]
+//	testbasher decode [file]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// commands maps the subcommand names to their implementations.
+var commands = map[string]func(args []string, stdin io.Reader, stdout, stderr io.Writer) int{
+	"list":   list,
+	"replay": replay,
+	"decode": decode,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the subcommand specified in args, returning the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		if args[0] != "help" && args[0] != "-h" && args[0] != "--help" {
+			fmt.Fprintf(stderr, "testbasher: unknown command %q\n", args[0])
+		}
+		usage(stderr)
+		return 2
+	}
+	return command(args[1:], stdin, stdout, stderr)
+}
+
+// usage writes a brief synopsis of the subcommands to w.
+func usage(w io.Writer) {
+	fmt.Fprint(w, `usage:
+  testbasher list [dir|bundle ...]
+      lists kept Basher temporary directories and reproduction bundles,
+      defaulting to $TESTBASHER_TMPDIR or the system's temporary directory.
+  testbasher replay [-stdin] [-timeout d] [-keep] dir|bundle [entry [arg ...]]
+      runs the entry script, replaying the recorded input and pretty-printing
+      the JSON output.
+  testbasher decode [file]
+      pretty-prints a JSON stream read from a file or stdin.
+`)
+}
+
+// flagset returns a new flag set for the named subcommand, reporting errors
+// to w.
+func flagset(name string, w io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("testbasher "+name, flag.ContinueOnError)
+	fs.SetOutput(w)
+	return fs
+}
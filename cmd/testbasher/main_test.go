@@ -0,0 +1,33 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("testbasher command", func() {
+
+	It("rejects unknown commands", func() {
+		var stdout, stderr bytes.Buffer
+		Expect(run([]string{"foo"}, nil, &stdout, &stderr)).To(Equal(2))
+		Expect(stderr.String()).To(HavePrefix("testbasher: unknown command \"foo\"\nusage:"))
+		Expect(run(nil, nil, &stdout, &stderr)).To(Equal(2))
+	})
+
+})
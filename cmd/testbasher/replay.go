@@ -0,0 +1,303 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/thediveo/testbasher"
+)
+
+// replay runs an entry script from a kept Basher directory or a reproduction
+// bundle, extracted or not, feeding it the recorded input and pretty-printing
+// its JSON output.
+// Inputs are only sent after the entry script has produced the output
+// recorded before them, as was the case in the original test. Without a
+// recorded transcript, or when asked to, the entry script gets our own stdin
+// (after the transcript).
+func replay(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flagset("replay", stderr)
+	passthrough := fs.Bool("stdin", false, "pass stdin to the entry script after replaying the transcript")
+	timeout := fs.Duration("timeout", 10*time.Second, "maximum time to wait for each recorded output")
+	keep := fs.Bool("keep", false, "keep the extracted bundle")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(stderr, "testbasher: missing Basher directory or bundle to replay")
+		return 2
+	}
+	src := fs.Arg(0)
+	info, err := os.Stat(src)
+	if err != nil {
+		fmt.Fprintf(stderr, "testbasher: %v\n", err)
+		return 1
+	}
+	var dir string
+	var manifest testbasher.Manifest
+	if info.IsDir() {
+		dir = src
+		// An extracted bundle still has its manifest.
+		mjson, err := os.ReadFile(filepath.Join(dir, testbasher.ManifestFilename))
+		if err == nil {
+			err = json.Unmarshal(mjson, &manifest)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(stderr, "testbasher: %q: invalid manifest, reason: %v\n", src, err)
+			return 1
+		}
+	} else {
+		tmpdir, err := os.MkdirTemp("", "testbasher-replay-")
+		if err != nil {
+			fmt.Fprintf(stderr, "testbasher: %v\n", err)
+			return 1
+		}
+		if *keep {
+			defer fmt.Fprintf(stderr, "testbasher: keeping extracted bundle in %s\n", tmpdir)
+		} else {
+			defer os.RemoveAll(tmpdir)
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			fmt.Fprintf(stderr, "testbasher: %v\n", err)
+			return 1
+		}
+		dir, manifest, err = testbasher.ExtractBundle(f, tmpdir)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(stderr, "testbasher: %q: %v\n", src, err)
+			return 1
+		}
+	}
+	// An explicitly specified entry script overrides the recorded one, as
+	// do its arguments; the recorded transcript then only applies if it's
+	// still the same entry script.
+	if fs.NArg() > 1 {
+		entry := strings.TrimSuffix(fs.Arg(1), ".sh")
+		if entry != manifest.Entry {
+			manifest.Transcript = nil
+		}
+		manifest.Entry = entry
+		manifest.Args = fs.Args()[2:]
+	}
+	if manifest.Entry == "" {
+		fmt.Fprintf(stderr, "testbasher: no entry script specified, choose from: %s\n",
+			strings.Join(testbasher.ScriptNames(dir), ", "))
+		return 2
+	}
+
+	cmd := exec.Command(filepath.Join(dir, manifest.Entry+".sh"), manifest.Args...)
+	var mu sync.Mutex // serializes our input echo with the script's output.
+	cmd.Stderr = &lockedWriter{w: stderr, mu: &mu}
+	// Run the entry script in its own process group, so we can get rid of
+	// it including its children in case it gets stuck.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintf(stderr, "testbasher: %v\n", err)
+		return 1
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		fmt.Fprintf(stderr, "testbasher: %v\n", err)
+		return 1
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(stderr, "testbasher: cannot start entry script, reason: %v\n", err)
+		return 1
+	}
+
+	status := 0
+	values := make(chan json.RawMessage)
+	decoded := make(chan error, 1)
+	go func() {
+		decoded <- prettyPrint(out, stdout, &mu, values)
+		close(values)
+	}()
+	report := func(format string, a ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(stderr, "testbasher: "+format+"\n", a...)
+	}
+	tell := func(text string) bool {
+		report("> %s", text)
+		if _, err := io.WriteString(in, text+"\n"); err != nil {
+			report("cannot send input, reason: %v", err)
+			status = 1
+			return false
+		}
+		return true
+	}
+transcript:
+	for _, step := range manifest.Transcript {
+		switch step.Op {
+		case testbasher.StepTell:
+			if !tell(step.Text) {
+				break transcript
+			}
+		case testbasher.StepProceed:
+			if !tell("") {
+				break transcript
+			}
+		case testbasher.StepDecode:
+			select {
+			case value, ok := <-values:
+				if !ok {
+					report("entry script output ended before recorded output %s", step.Value)
+					status = 1
+					break transcript
+				}
+				if !jsonEqual(value, step.Value) {
+					report("output differs from recorded output %s", step.Value)
+					status = 1
+				}
+			case <-time.After(*timeout):
+				report("timeout waiting for recorded output %s", step.Value)
+				status = 1
+				_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				break transcript
+			}
+		}
+	}
+	if *passthrough || manifest.Transcript == nil {
+		go func() {
+			_, _ = io.Copy(in, stdin)
+			in.Close()
+		}()
+	} else {
+		in.Close()
+	}
+	for range values {
+	}
+	if err := <-decoded; err != nil {
+		report("%v", err)
+		status = 1
+	}
+	if err := cmd.Wait(); err != nil {
+		report("entry script %q failed: %v", manifest.Entry, err)
+		status = 1
+	}
+	return status
+}
+
+// decode pretty-prints the JSON stream read from the file specified in args,
+// or otherwise from stdin.
+func decode(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flagset("decode", stderr)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintln(stderr, "testbasher: too many files to decode")
+		return 2
+	}
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(stderr, "testbasher: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		stdin = f
+	}
+	if err := prettyPrint(stdin, stdout, &sync.Mutex{}, nil); err != nil {
+		fmt.Fprintf(stderr, "testbasher: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// prettyPrint decodes the JSON stream read from r, writing the values
+// indented to w while holding the specified lock. If values isn't nil, the
+// decoded values are additionally sent to it. prettyPrint returns nil when
+// reaching the end of the stream, otherwise the decoding error, detailing
+// where things went wrong.
+func prettyPrint(r io.Reader, w io.Writer, mu *sync.Mutex, values chan<- json.RawMessage) error {
+	dec := testbasher.NewDecoder(&lineReader{r: bufio.NewReader(r)})
+	for {
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, value, "", "  "); err != nil {
+			return err
+		}
+		mu.Lock()
+		fmt.Fprintln(w, pretty.String())
+		mu.Unlock()
+		if values != nil {
+			values <- value
+		}
+	}
+}
+
+// lineReader hands out at most a single line per Read, so that the decoder
+// sees the output of scripts in the same chunks as it has been written by
+// them.
+type lineReader struct {
+	r    *bufio.Reader
+	line []byte // rest of the current line not yet read.
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	if len(l.line) == 0 {
+		line, err := l.r.ReadSlice('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		l.line = line
+	}
+	n := copy(p, l.line)
+	l.line = l.line[n:]
+	return n, nil
+}
+
+// lockedWriter serializes writes to w using the specified lock.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// jsonEqual returns true if both JSON values are semantically equal.
+func jsonEqual(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
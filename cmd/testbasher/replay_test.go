@@ -0,0 +1,114 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thediveo/testbasher"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// bundle runs the specified script with a Basher, telling it "foo" and
+// decoding its output, and then writes a reproduction bundle, returning the
+// path of the bundle.
+func bundle(script string) string {
+	b := testbasher.Basher{}
+	defer b.Done()
+	b.Script("entry", script)
+	cmd := b.Start("entry", "World")
+	cmd.Tell("foo")
+	var v interface{}
+	cmd.Decode(&v)
+	cmd.Close()
+	p := filepath.Join(GinkgoT().TempDir(), "repro.tgz")
+	f, err := os.Create(p)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+	Expect(b.Bundle(f, cmd)).To(Succeed())
+	return p
+}
+
+var _ = Describe("replaying", func() {
+
+	It("replays bundles", func() {
+		p := bundle(`read IN && echo "{\"$1\": \"$IN\"}" && read`)
+		var stdout, stderr bytes.Buffer
+		Expect(run([]string{"replay", p}, nil, &stdout, &stderr)).To(Equal(0), stderr.String())
+		Expect(stdout.String()).To(Equal("{\n  \"World\": \"foo\"\n}\n"))
+		Expect(stderr.String()).To(Equal("testbasher: > foo\ntestbasher: > \n"))
+	})
+
+	It("reports differing output", func() {
+		p := bundle(`read IN && echo "\"$(date +%s%N)\"" && read`)
+		var stdout, stderr bytes.Buffer
+		Expect(run([]string{"replay", p}, nil, &stdout, &stderr)).To(Equal(1))
+		Expect(stderr.String()).To(ContainSubstring("output differs from recorded output"))
+	})
+
+	It("replays Basher directories interactively", func() {
+		root := GinkgoT().TempDir()
+		b := testbasher.Basher{TempDir: root}
+		defer b.Done()
+		b.Script("entry", `read IN && echo "[\"$1\", \"$IN\"]"`)
+		dirs, err := filepath.Glob(filepath.Join(root, "*"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dirs).To(HaveLen(1))
+
+		var stdout, stderr bytes.Buffer
+		Expect(run([]string{"replay", dirs[0]}, nil, &stdout, &stderr)).To(Equal(2))
+		Expect(stderr.String()).To(ContainSubstring("no entry script specified, choose from: entry"))
+
+		stdout.Reset()
+		stderr.Reset()
+		Expect(run([]string{"replay", dirs[0], "entry", "bar"}, strings.NewReader("baz\n"),
+			&stdout, &stderr)).To(Equal(0), stderr.String())
+		Expect(stdout.String()).To(Equal("[\n  \"bar\",\n  \"baz\"\n]\n"))
+	})
+
+	It("replays extracted bundles", func() {
+		p := bundle(`read IN && echo "\"Hello, $1 and ${IN}!\"" && read`)
+		f, err := os.Open(p)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		dir, _, err := testbasher.ExtractBundle(f, GinkgoT().TempDir())
+		Expect(err).NotTo(HaveOccurred())
+
+		var stdout, stderr bytes.Buffer
+		Expect(run([]string{"replay", dir}, nil, &stdout, &stderr)).To(Equal(0), stderr.String())
+		Expect(stdout.String()).To(Equal("\"Hello, World and foo!\"\n"))
+		Expect(stderr.String()).To(ContainSubstring("testbasher: > foo"))
+
+		Expect(os.WriteFile(filepath.Join(dir, testbasher.ManifestFilename), []byte("{"), 0644)).To(Succeed())
+		stderr.Reset()
+		Expect(run([]string{"replay", dir}, nil, &stdout, &stderr)).To(Equal(1))
+		Expect(stderr.String()).To(ContainSubstring("invalid manifest"))
+	})
+
+	It("reports JSON errors in detail", func() {
+		var stdout, stderr bytes.Buffer
+		Expect(run([]string{"decode"}, strings.NewReader("42\n{\"foo\": bar}\n"),
+			&stdout, &stderr)).To(Equal(1))
+		Expect(stdout.String()).To(Equal("42\n"))
+		Expect(stderr.String()).To(ContainSubstring("while reading:"))
+		Expect(stderr.String()).To(ContainSubstring("while reading:\n\t{\"foo\": b"))
+	})
+
+})
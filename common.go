@@ -0,0 +1,221 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// commondirname is the name of the subdirectory in the temporary directory
+// receiving the common scripts, so they never clash with the other scripts.
+// This name is reserved, so it cannot be used for fixture files.
+const commondirname = ".testbasher-common"
+
+// common describes a common script block, which gets sourced in all or only
+// selected (non-common) scripts.
+type common struct {
+	name    string   // name of common script.
+	path    string   // temporary common script file.
+	body    string   // common script body, without header.
+	origin  location // where the common script body originates from.
+	after   []string // names of other common scripts to source before this one.
+	onlyfor []string // names of scripts to source this common script in; nil for all.
+}
+
+// CommonOption configures a common script; see CommonNamed.
+type CommonOption func(*common)
+
+// After sources a common script only after the named other common scripts.
+// The other common scripts may be added later, but they must be known by the
+// time a script gets started.
+func After(names ...string) CommonOption {
+	return func(c *common) {
+		c.after = append(c.after, names...)
+	}
+}
+
+// OnlyFor sources a common script only in the named scripts, instead of all
+// scripts. The scripts may be added later, but they must be known by the time
+// a script gets started.
+func OnlyFor(scripts ...string) CommonOption {
+	return func(c *common) {
+		for _, script := range scripts {
+			c.onlyfor = append(c.onlyfor, strings.TrimSuffix(script, ".sh"))
+		}
+	}
+}
+
+// Common adds an unnamed script with common definitions, which are then
+// automatically made available to all (non-common) scripts. The common
+// scripts are sourced in the order they were added. They are named
+// “common-<n>”, where n counts the unnamed common scripts, starting with
+// “common-1” and skipping names already taken by named common scripts; see
+// also CommonNamed.
+func (b *Basher) Common(script string) {
+	b.init()
+	var name string
+	for {
+		b.commonno++
+		name = fmt.Sprintf("common-%d", b.commonno)
+		if !b.hasCommon(name) {
+			break
+		}
+	}
+	b.addCommon(name, script, caller(1))
+}
+
+// hasCommon returns true if there already is a common script with the
+// specified name.
+func (b *Basher) hasCommon(name string) bool {
+	for _, c := range b.commons {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CommonNamed adds a named script with common definitions, which are then
+// automatically made available to all (non-common) scripts, unless restricted
+// using OnlyFor. Common scripts are sourced in the order they were added,
+// unless ordered otherwise using After. Adding a common script with the same
+// name as an already existing common script replaces the existing one, but
+// keeps its position in the order of common scripts.
+func (b *Basher) CommonNamed(name, script string, opts ...CommonOption) {
+	b.init()
+	b.addCommon(name, script, caller(1), opts...)
+}
+
+// addCommon creates a temporary common script file from the given script,
+// adding or replacing the common script with the specified name.
+func (b *Basher) addCommon(name, script string, origin location, opts ...CommonOption) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		panic(fmt.Errorf("Basher: invalid common script name %q", name))
+	}
+	c := &common{
+		name:   name,
+		path:   filepath.Join(b.tmpdir, commondirname, name+".sh"),
+		body:   script,
+		origin: origin,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		panic(fmt.Errorf(
+			"Basher: cannot create temporary directory for common scripts, reason: %v",
+			err))
+	}
+	writeScript(name, c.path, script, os.O_TRUNC)
+	if b.Lint {
+		b.lint(fmt.Sprintf("common script %q", name), c.path, 1, origin)
+	}
+	replaced := false
+	for idx, other := range b.commons {
+		if other.name == name {
+			b.commons[idx] = c
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		b.commons = append(b.commons, c)
+	}
+	b.writeDefs()
+}
+
+// sourcing returns the shell code for sourcing this common script, taking its
+// script restrictions into account.
+func (c *common) sourcing(b *Basher) string {
+	if c.onlyfor == nil {
+		return ". " + shellquote(c.path) + "\n"
+	}
+	// As the definitions script is sourced by the scripts, BASH_SOURCE[1]
+	// refers to the particular script sourcing the definitions.
+	patterns := make([]string, len(c.onlyfor))
+	for idx, name := range c.onlyfor {
+		patterns[idx] = shellquote(filepath.Join(b.tmpdir, name+".sh"))
+	}
+	return fmt.Sprintf("case \"${BASH_SOURCE[1]}\" in %s) . %s ;; esac\n",
+		strings.Join(patterns, "|"), shellquote(c.path))
+}
+
+// orderedCommons returns the common scripts in the order they need to be
+// sourced, which is the order they were added, unless their dependencies
+// dictate otherwise. Dependencies on unknown common scripts are ignored, so
+// they can be added later. An error is returned in case of cyclic
+// dependencies.
+func (b *Basher) orderedCommons() ([]*common, error) {
+	commons := map[string]*common{}
+	for _, c := range b.commons {
+		commons[c.name] = c
+	}
+	ordered := make([]*common, 0, len(b.commons))
+	done := map[string]bool{} // false: in progress, true: done.
+	var visit func(c *common, path []string) error
+	visit = func(c *common, path []string) error {
+		if fin, ok := done[c.name]; ok {
+			if !fin {
+				return fmt.Errorf("cyclic common script dependencies %s",
+					strings.Join(append(path, c.name), " → "))
+			}
+			return nil
+		}
+		done[c.name] = false
+		for _, dep := range c.after {
+			if depc, ok := commons[dep]; ok {
+				if err := visit(depc, append(path, c.name)); err != nil {
+					return err
+				}
+			}
+		}
+		done[c.name] = true
+		ordered = append(ordered, c)
+		return nil
+	}
+	for _, c := range b.commons {
+		if err := visit(c, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// checkCommons returns an error if a common script depends on an unknown
+// common script, or is restricted to an unknown script.
+func (b *Basher) checkCommons() error {
+	commons := map[string]bool{}
+	for _, c := range b.commons {
+		commons[c.name] = true
+	}
+	for _, c := range b.commons {
+		for _, dep := range c.after {
+			if !commons[dep] {
+				return fmt.Errorf("common script %q depends on unknown common script %q",
+					c.name, dep)
+			}
+		}
+		for _, script := range c.onlyfor {
+			if _, ok := b.scripts[script]; !ok {
+				return fmt.Errorf("common script %q is restricted to unknown script %q",
+					c.name, script)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"os"
+	"path/filepath"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Basher common scripts", func() {
+
+	It("names common scripts", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Common(`FOO=1`)
+		b.CommonNamed("netns-helpers", `BAR=2`)
+		Expect(b.commons).To(HaveLen(2))
+		Expect(b.commons[0].name).To(Equal("common-1"))
+		Expect(b.commons[0].path).To(BeARegularFile())
+		Expect(b.commons[1].path).To(Equal(
+			filepath.Join(b.tmpdir, commondirname, "netns-helpers.sh")))
+	})
+
+	It("doesn't replace named common scripts by unnamed ones", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Common(`FOO=1`)
+		b.CommonNamed("common-2", `BAR=2`)
+		b.Common(`BAZ=3`)
+		b.CommonNamed("common-1", `FOO=one`)
+		Expect(b.commons).To(HaveLen(3))
+		body := func(c *common) string {
+			content, err := os.ReadFile(c.path)
+			Expect(err).NotTo(HaveOccurred())
+			return string(content)
+		}
+		Expect(body(b.commons[0])).To(HaveSuffix("FOO=one\n"))
+		Expect(body(b.commons[1])).To(HaveSuffix("BAR=2\n"))
+		Expect(b.commons[2].name).To(Equal("common-3"))
+		Expect(body(b.commons[2])).To(HaveSuffix("BAZ=3\n"))
+	})
+
+	It("keeps common scripts away from fixtures", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Dir("common", fstest.MapFS{"foo": &fstest.MapFile{Data: []byte("foo")}})
+		b.Common(`FOO=1`)
+		entries, err := os.ReadDir(filepath.Join(b.tmpdir, "common"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(func() { b.File(commondirname, nil, 0644) }).To(PanicWith(MatchError(
+			`Basher: reserved file name ".testbasher-common"`)))
+	})
+
+	It("orders and replaces common scripts", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.CommonNamed("second", `FOO="$FOO second"`, After("first"))
+		b.CommonNamed("first", `FOO="first"`)
+		b.CommonNamed("third", `FOO="$FOO third"`)
+		b.CommonNamed("third", `FOO="$FOO THIRD"`)
+		b.Script("script", `echo "\"$FOO\"" && read`)
+		cmd := b.Start("script")
+		defer cmd.Close()
+
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal("first second THIRD"))
+	})
+
+	It("restricts common scripts to selected scripts", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.CommonNamed("foo", `FOO="foo"`, OnlyFor("foo"))
+		b.Script("foo", `echo "\"<$FOO>\"" && $bar`)
+		b.Script("bar", `echo "\"<$FOO>\"" && read`)
+		cmd := b.Start("foo")
+		defer cmd.Close()
+
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal("<foo>"))
+		cmd.Decode(&s)
+		Expect(s).To(Equal("<>"))
+	})
+
+	It("rejects invalid common scripts", func() {
+		b := Basher{}
+		defer b.Done()
+
+		Expect(func() { b.CommonNamed("a/b", "") }).To(PanicWith(MatchError(
+			`Basher: invalid common script name "a/b"`)))
+
+		b.Script("script", "")
+		b.CommonNamed("a", "", After("b"))
+		Expect(func() { b.Start("script") }).To(PanicWith(MatchError(
+			`Basher: cannot run script "script", reason: common script "a" depends on unknown common script "b"`)))
+		Expect(func() { b.CommonNamed("b", "", After("a")) }).To(PanicWith(MatchError(
+			`Basher: cyclic common script dependencies a → b → a`)))
+
+		b2 := Basher{}
+		defer b2.Done()
+		b2.Script("script", "")
+		b2.CommonNamed("a", "", OnlyFor("foo"))
+		Expect(func() { b2.Start("script") }).To(PanicWith(MatchError(
+			`Basher: cannot run script "script", reason: common script "a" is restricted to unknown script "foo"`)))
+	})
+
+})
@@ -0,0 +1,112 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Do runs the specified function in the namespaces of the specified types of
+// this command, returning the function's error. Without any namespace types,
+// fn runs in all namespaces of the command which differ from the test
+// process' namespaces and which can be joined. This allows tests to check
+// things from Go inside the namespaces set up by a script, such as listing
+// network interfaces or opening sockets.
+//
+// Do runs fn on a separate, locked OS thread, switching back into the
+// original namespaces afterwards. Thus, fn must not start other goroutines for
+// doing work inside the namespaces. If fn panics, such as due to a failed
+// assertion, then Do panics with the same value. When joining a mount
+// namespace, the OS thread cannot be switched back and thus gets terminated
+// afterwards.
+//
+// As the Linux kernel doesn't allow multi-threaded processes to join user
+// and time namespaces, Do returns an error for these namespace types. Please
+// note that this also means that unprivileged test processes cannot join
+// namespaces owned by a user namespace of the command, as they lack
+// CAP_SYS_ADMIN in that user namespace; Do then fails with EPERM, so use a
+// script started using Basher.StartIn instead. Please also note that joining
+// a PID namespace only affects child processes started by fn, but not fn
+// itself.
+func (cmd *TestCommand) Do(types []NamespaceType, fn func() error) error {
+	return doIn(cmd.cmd.Process.Pid, types, fn)
+}
+
+// DoInnermost runs the specified function in the namespaces of the last
+// process in the chain of single child processes of this command, in order to
+// support the command having “unshare”d itself using a child process. Apart
+// from that, DoInnermost behaves exactly like Do; see also Basher.StartIn.
+func (cmd *TestCommand) DoInnermost(types []NamespaceType, fn func() error) error {
+	return doIn(cmd.innermost(), types, fn)
+}
+
+// doIn runs fn in the namespaces of the specified types of the specified
+// process.
+func doIn(pid int, types []NamespaceType, fn func() error) error {
+	fail := func(t NamespaceType, err error) error {
+		hint := joinHint(err)
+		if errors.Is(err, syscall.EPERM) && !sameUserNamespace(pid) {
+			hint = " (test processes without CAP_SYS_ADMIN in the user namespace owning " +
+				"the namespace cannot join it using Do, as multi-threaded processes cannot " +
+				"join user namespaces; use Basher.StartIn instead)"
+		}
+		return fmt.Errorf("TestCommand: cannot run in %s namespace of process %d, reason: %v%s",
+			t, pid, err, hint)
+	}
+	if types == nil {
+		differing, err := differingNamespaces(pid)
+		if err != nil {
+			return err
+		}
+		for _, t := range differing {
+			if selfjoinable(t) || t == MountNS {
+				types = append(types, t)
+			}
+		}
+	}
+	var joins []nsfile
+	defer func() {
+		for _, join := range joins {
+			join.f.Close()
+		}
+	}()
+	for _, t := range types {
+		if !selfjoinable(t) && t != MountNS {
+			return fmt.Errorf(
+				"TestCommand: cannot run in %s namespace of process %d, reason: multi-threaded processes cannot join %s namespaces",
+				t, pid, t)
+		}
+		f, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", pid, t))
+		if err != nil {
+			return fail(t, err)
+		}
+		joins = append(joins, nsfile{typ: t, f: f})
+	}
+	return inNamespaces(joins, fail, false, fn)
+}
+
+// sameUserNamespace returns true if the specified process is in the same user
+// namespace as the test process, or if this cannot be determined.
+func sameUserNamespace(pid int) bool {
+	own, err := NamespaceOf(os.Getpid(), UserNS)
+	if err != nil {
+		return true
+	}
+	other, err := NamespaceOf(pid, UserNS)
+	return err != nil || own.SameAs(other)
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("running Go code in namespaces", func() {
+
+	It("runs functions in the namespaces of a command", func() {
+		c := NewTestCommandWith("/bin/bash", []string{"-c",
+			`ip link set lo up && hostname doing && echo '"ok"' && read`},
+			NewNamespaces(UserNS, NetNS, UTSNS), MapRoot())
+		defer c.Close()
+		var s string
+		c.Decode(&s)
+
+		var netifs []net.Interface
+		var hostname string
+		Expect(c.Do(nil, func() (err error) {
+			if netifs, err = net.Interfaces(); err != nil {
+				return
+			}
+			hostname, err = os.Hostname()
+			return
+		})).To(Succeed())
+		Expect(netifs).To(ConsistOf(HaveField("Name", "lo")))
+		Expect(netifs[0].Flags & net.FlagUp).NotTo(BeZero())
+		Expect(hostname).To(Equal("doing"))
+
+		// Ensure that we're back in our namespaces.
+		own, err := os.Hostname()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(own).NotTo(Equal("doing"))
+
+		Expect(c.Do([]NamespaceType{UTSNS}, func() error {
+			hostname, err = os.Hostname()
+			return err
+		})).To(Succeed())
+		Expect(hostname).To(Equal("doing"))
+	})
+
+	It("follows the command's descendants", func() {
+		b := Basher{}
+		defer b.Done()
+		b.Script("outer", `unshare -Ufr --uts $inner`)
+		b.Script("inner", `hostname inner && echo '"ok"' && read`)
+		c := b.Start("outer")
+		defer c.Close()
+		var s string
+		c.Decode(&s)
+
+		var hostname string
+		Expect(c.DoInnermost(nil, func() (err error) {
+			hostname, err = os.Hostname()
+			return
+		})).To(Succeed())
+		Expect(hostname).To(Equal("inner"))
+	})
+
+	It("runs functions in mount namespaces", func() {
+		dir := GinkgoT().TempDir()
+		c := NewTestCommandWith("/bin/bash", []string{"-c",
+			`mount -t tmpfs none "$0" && touch "$0/doing" && echo '"ok"' && read`, dir},
+			NewNamespaces(UserNS, MountNS), MapRoot())
+		defer c.Close()
+		var s string
+		c.Decode(&s)
+
+		wd, err := os.Getwd()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Do(nil, func() error {
+			_, err := os.Stat(filepath.Join(dir, "doing"))
+			return err
+		})).To(Succeed())
+		Expect(filepath.Join(dir, "doing")).NotTo(BeAnExistingFile())
+		Expect(os.Getwd()).To(Equal(wd))
+	})
+
+	It("returns errors and passes panics", func() {
+		c := NewTestCommandWith("/bin/bash", []string{"-c", `echo '"ok"' && read`},
+			NewNamespaces(UserNS, MountNS, UTSNS), MapRoot())
+		defer c.Close()
+		var s string
+		c.Decode(&s)
+
+		err := errors.New("foobar")
+		Expect(c.Do(nil, func() error { return err })).To(BeIdenticalTo(err))
+		Expect(func() {
+			_ = c.Do(nil, func() error { panic("foobar") })
+		}).To(PanicWith("foobar"))
+		Expect(c.Do([]NamespaceType{UserNS}, func() error { return nil })).To(MatchError(
+			MatchRegexp(`^TestCommand: cannot run in user namespace of process \d+, reason: multi-threaded processes cannot join user namespaces$`)))
+		Expect(doIn(-42, []NamespaceType{NetNS}, func() error { return nil })).To(MatchError(
+			ContainSubstring("cannot run in net namespace of process -42")))
+	})
+
+})
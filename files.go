@@ -0,0 +1,101 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// File adds a (non-script) fixture file with the given name, content and
+// permissions to the temporary directory of this Basher. Scripts then
+// reference the file via its variable, in the same way as they reference other
+// scripts: file “config.json” has the associated variable “$config_json”
+// pointing to its temporary location.
+func (b *Basher) File(name string, content []byte, mode fs.FileMode) {
+	b.init()
+	filename := b.addFile(name)
+	if err := os.WriteFile(filename, content, mode); err != nil {
+		panic(fmt.Errorf("Basher: cannot create temporary file %q, reason: %v",
+			filename, err))
+	}
+}
+
+// JSONFile adds a fixture file with the given name and the JSON-encoded
+// value as its contents. See File for details.
+func (b *Basher) JSONFile(name string, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Errorf("Basher: cannot JSON-encode file %q, reason: %v", name, err))
+	}
+	b.File(name, content, 0644)
+}
+
+// Dir adds a fixture directory with the given name, copying the whole
+// directory tree from the specified file system into it. Scripts reference
+// the directory via its variable; see File for details.
+func (b *Basher) Dir(name string, fsys fs.FS) {
+	b.init()
+	dirpath := b.addFile(name)
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dirpath, filepath.FromSlash(path))
+		if d.IsDir() {
+			return os.Mkdir(target, 0755)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		mode := info.Mode().Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		return os.WriteFile(target, content, mode)
+	})
+	if err != nil {
+		panic(fmt.Errorf("Basher: cannot create temporary directory %q, reason: %v",
+			dirpath, err))
+	}
+}
+
+// addFile reserves the specified name for a fixture file or directory, and
+// returns its path in the temporary directory. It defines the associated
+// variable that points to this path.
+func (b *Basher) addFile(name string) string {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		panic(fmt.Errorf("Basher: invalid file name %q", name))
+	}
+	if name == commondirname {
+		panic(fmt.Errorf("Basher: reserved file name %q", name))
+	}
+	filename := filepath.Join(b.tmpdir, name)
+	if _, err := os.Lstat(filename); err == nil {
+		panic(fmt.Errorf("Basher: file %q already exists", name))
+	}
+	varname := b.VarPrefix + allowednamechars.ReplaceAllString(name, "_")
+	b.claimVar(varname, fmt.Sprintf("file %q", name))
+	b.definePath(varname, filename)
+	return filename
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Basher fixture files", func() {
+
+	It("provides fixture files and directories to scripts", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.File("hello.txt", []byte(`"Hello, World!"`), 0600)
+		b.JSONFile("answer.json", map[string]int{"answer": 42})
+		b.Dir("tree", fstest.MapFS{
+			"a/b/c.json": {Data: []byte(`"c"`), Mode: 0640},
+		})
+		b.Script("script", `
+echo "[$(cat "$hello_txt"), $(cat "$answer_json"), $(cat "$tree/a/b/c.json")]"
+read`)
+		cmd := b.Start("script")
+		defer cmd.Close()
+
+		var v []interface{}
+		cmd.Decode(&v)
+		Expect(v).To(HaveExactElements(
+			"Hello, World!",
+			HaveKeyWithValue("answer", BeEquivalentTo(42)),
+			"c"))
+	})
+
+	It("rejects invalid and duplicate file names", func() {
+		b := Basher{}
+		defer b.Done()
+
+		Expect(func() { b.File("a/b", nil, 0644) }).To(PanicWith(MatchError(
+			`Basher: invalid file name "a/b"`)))
+		Expect(func() { b.File("basher-defs.sh", nil, 0644) }).To(PanicWith(MatchError(
+			`Basher: file "basher-defs.sh" already exists`)))
+		b.File("foo.txt", nil, 0644)
+		Expect(func() { b.Dir("foo.txt", fstest.MapFS{}) }).To(Panic())
+		Expect(func() { b.JSONFile("chan", make(chan int)) }).To(Panic())
+	})
+
+})
@@ -0,0 +1,78 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// Processes returns the process tree of this command, that is, the command's
+// process and all its descendants, in depth-first order with siblings sorted
+// by PID. Processes returns nil if the command's process has already
+// terminated.
+func (cmd *TestCommand) Processes() []Process {
+	stats := procStats()
+	root, ok := stats[cmd.cmd.Process.Pid]
+	if !ok {
+		return nil
+	}
+	children := map[int][]int{}
+	for _, ps := range stats {
+		children[ps.ppid] = append(children[ps.ppid], ps.pid)
+	}
+	var procs []Process
+	var visit func(ps procStat)
+	visit = func(ps procStat) {
+		procs = append(procs, ps.process())
+		kids := children[ps.pid]
+		sort.Ints(kids)
+		for _, kid := range kids {
+			visit(stats[kid])
+		}
+	}
+	visit(root)
+	return procs
+}
+
+// Namespaces returns the namespaces of the processes in the process tree of
+// this command, indexed by PID and then namespace type, as inode numbers.
+// Processes terminating in the meantime are skipped, as are namespace types
+// not supported by the kernel.
+func (cmd *TestCommand) Namespaces() map[int]map[NamespaceType]uint64 {
+	namespaces := map[int]map[NamespaceType]uint64{}
+	for _, proc := range cmd.Processes() {
+		if ns := processNamespaces(proc.PID); len(ns) > 0 {
+			namespaces[proc.PID] = ns
+		}
+	}
+	return namespaces
+}
+
+// processNamespaces returns the inode numbers of the namespaces of the
+// specified process, indexed by namespace type.
+func processNamespaces(pid int) map[NamespaceType]uint64 {
+	namespaces := map[NamespaceType]uint64{}
+	for _, nstype := range namespaceTypes {
+		info, err := os.Stat(fmt.Sprintf("/proc/%d/ns/%s", pid, nstype.name))
+		if err != nil {
+			continue
+		}
+		namespaces[nstype.typ] = info.Sys().(*syscall.Stat_t).Ino
+	}
+	return namespaces
+}
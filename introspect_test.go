@@ -0,0 +1,69 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"os"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// ownNamespaceIno returns the inode number of our own namespace of the
+// specified type.
+func ownNamespaceIno(t NamespaceType) uint64 {
+	info, err := os.Stat("/proc/self/ns/" + t.String())
+	Expect(err).NotTo(HaveOccurred())
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+var _ = Describe("introspection", func() {
+
+	It("returns the process tree and its namespaces", func() {
+		b := Basher{}
+		defer b.Done()
+		b.Script("outer", `unshare -Ufr --net $inner`)
+		b.Script("inner", `echo "$$" && read`)
+		c := b.Start("outer")
+		defer c.Close()
+		var innerpid int
+		c.Decode(&innerpid)
+
+		// Depending on its version and options, unshare might fork, so there
+		// might be an additional process in between.
+		procs := c.Processes()
+		Expect(len(procs)).To(BeNumerically(">=", 2))
+		Expect(procs[0]).To(And(
+			HaveField("PID", c.cmd.Process.Pid), HaveField("PPID", os.Getpid()),
+			HaveField("Comm", "outer.sh")))
+		Expect(procs[len(procs)-1]).To(And(
+			HaveField("PID", innerpid), HaveField("PPID", procs[len(procs)-2].PID),
+			HaveField("Comm", "inner.sh"),
+			HaveField("Cmdline", ContainElement(b.scripts["inner"].path))))
+
+		namespaces := c.Namespaces()
+		Expect(namespaces).To(HaveLen(len(procs)))
+		Expect(namespaces[c.cmd.Process.Pid]).To(HaveKeyWithValue(NetNS, ownNamespaceIno(NetNS)))
+		Expect(namespaces[innerpid]).To(HaveKeyWithValue(NetNS, Not(Equal(ownNamespaceIno(NetNS)))))
+		Expect(namespaces[innerpid]).To(HaveKeyWithValue(UserNS, Not(Equal(ownNamespaceIno(UserNS)))))
+		Expect(namespaces[innerpid]).To(HaveKeyWithValue(UTSNS, ownNamespaceIno(UTSNS)))
+
+		c.Close()
+		Expect(c.Processes()).To(BeNil())
+		Expect(c.Namespaces()).To(BeEmpty())
+	})
+
+})
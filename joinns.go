@@ -0,0 +1,322 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// InNamespacesOf starts the command in the existing namespaces of the
+// specified types of the process with the specified PID, such as the
+// namespaces created by another TestCommand. Without any namespace types, the
+// command joins all namespaces of the process that differ from the namespaces
+// of the test process.
+//
+// The test process joins network, UTS, IPC, cgroup, and PID namespaces on a
+// locked OS thread just for starting the command. As the Linux kernel doesn't
+// allow multi-threaded processes to join user, mount and time namespaces, the
+// command gets started via “nsenter” for joining these namespaces. When
+// joining a user namespace, the command gets started via nsenter for joining
+// all namespaces, so that the user namespace gets joined first where
+// necessary. A Credential then applies inside the joined namespaces, using
+// setpriv(1).
+//
+// Please note that joining namespaces requires the test process to have
+// access to the other process, as well as the CAP_SYS_ADMIN capability in the
+// user namespaces owning the namespaces to join. Unprivileged test processes
+// thus need to join the owning user namespace, too. If the test process
+// cannot switch back into its original namespaces afterwards, then the locked
+// OS thread is sacrificed.
+func InNamespacesOf(pid int, types ...NamespaceType) StartOption {
+	return func(cmd *TestCommand) {
+		cmd.joinpid = pid
+		cmd.jointypes = types
+	}
+}
+
+// StartIn starts the named script as a new TestCommand in the namespaces of
+// another TestCommand, which differ from the namespaces of the test process.
+// In order to support the other command having “unshare”d itself using a
+// child process, StartIn follows the chain of single child processes of the
+// other command down to its end, if any, and joins the namespaces of the last
+// process in the chain. Thus, the other command should have finished creating
+// its namespaces, such as when it has output data that has been decoded.
+//
+// Apart from joining namespaces, StartIn behaves exactly like Start; see also
+// InNamespacesOf.
+func (b *Basher) StartIn(other *TestCommand, name string, args ...string) *TestCommand {
+	return newTestCommand(b.command(name, args), InNamespacesOf(other.innermost()), b.logTo, b.shareScripts)
+}
+
+// innermost returns the PID of the last process in the chain of single child
+// processes, starting with this command.
+func (cmd *TestCommand) innermost() int {
+	pid := cmd.cmd.Process.Pid
+	stats := procStats()
+	for {
+		child := 0
+		for _, ps := range stats {
+			if ps.ppid != pid {
+				continue
+			}
+			if child != 0 {
+				return pid // more than one child process.
+			}
+			child = ps.pid
+		}
+		if child == 0 {
+			return pid
+		}
+		pid = child
+	}
+}
+
+// nsenterflags maps namespace types to the corresponding nsenter flags.
+var nsenterflags = map[NamespaceType]string{
+	UserNS:   "--user",
+	MountNS:  "--mount",
+	TimeNS:   "--time",
+	NetNS:    "--net",
+	UTSNS:    "--uts",
+	IPCNS:    "--ipc",
+	CgroupNS: "--cgroup",
+	PIDNS:    "--pid",
+}
+
+// selfjoinable returns true if the (multi-threaded) test process can join a
+// namespace of the specified type itself.
+func selfjoinable(t NamespaceType) bool {
+	return t != UserNS && t != MountNS && t != TimeNS
+}
+
+// start starts the command, joining existing namespaces first, if necessary.
+func (cmd *TestCommand) start() error {
+	if cmd.joinpid == 0 {
+		return cmd.cmd.Start()
+	}
+	types := cmd.jointypes
+	if types == nil {
+		var err error
+		if types, err = differingNamespaces(cmd.joinpid); err != nil {
+			return err
+		}
+	}
+	// Check upfront that we can access all the namespaces to join and keep
+	// the namespaces we're going to join ourselves open, so they cannot go
+	// away.
+	var nsenter []string
+	var joins []nsfile
+	defer func() {
+		for _, join := range joins {
+			join.f.Close()
+		}
+	}()
+	// When joining a user namespace, nsenter needs to join all namespaces,
+	// as otherwise unprivileged test processes lack the capabilities to join
+	// namespaces owned by the user namespace.
+	userns := false
+	for _, t := range types {
+		userns = userns || t == UserNS
+	}
+	for _, t := range types {
+		f, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", cmd.joinpid, t))
+		if err != nil {
+			return cmd.joinError(t, err)
+		}
+		if userns || !selfjoinable(t) {
+			nsenter = append(nsenter, nsenterflags[t])
+			f.Close()
+			continue
+		}
+		joins = append(joins, nsfile{typ: t, f: f})
+	}
+	if len(nsenter) > 0 {
+		// nsenter must join the namespaces with the credentials of the test
+		// process, so any Credential needs to be applied afterwards.
+		if cmd.cmd.SysProcAttr.Credential != nil {
+			if err := cmd.wrap(append([]string{"setpriv"}, cmd.setprivCredential()...)...); err != nil {
+				return err
+			}
+		}
+		path, err := exec.LookPath("nsenter")
+		if err != nil {
+			return fmt.Errorf("TestCommand: cannot join %s namespaces of process %d without nsenter, reason: %v",
+				namespaceNames(types), cmd.joinpid, err)
+		}
+		cmd.cmd.Args = append(append(append([]string{"nsenter", "-t", strconv.Itoa(cmd.joinpid)},
+			nsenter...), "--", cmd.cmd.Path), cmd.cmd.Args[1:]...)
+		cmd.cmd.Path = path
+	}
+	if len(joins) == 0 {
+		return cmd.cmd.Start()
+	}
+	// If the command was started with a parent-death signal, then we must
+	// keep a stuck OS thread, as otherwise the command would receive its
+	// signal.
+	return inNamespaces(joins, cmd.joinError, cmd.cmd.SysProcAttr.Pdeathsig != 0, cmd.cmd.Start)
+}
+
+// nsfile is an open namespace file of a particular namespace type.
+type nsfile struct {
+	typ NamespaceType
+	f   *os.File
+}
+
+// inNamespaces runs fn on a locked OS thread in the specified namespaces,
+// switching back into the original namespaces afterwards, and returns the
+// error of fn. Errors joining a namespace are reported using fail instead. If
+// fn panics, then inNamespaces panics with the same value in the caller's
+// goroutine.
+//
+// If the OS thread cannot be switched back into its original namespaces, then
+// it gets terminated, unless keep is set and fn succeeded; the thread then
+// gets parked forever instead.
+func inNamespaces(joins []nsfile, fail func(NamespaceType, error) error, keep bool, fn func() error) error {
+	type result struct {
+		err      error
+		panicked bool
+		pval     interface{}
+	}
+	done := make(chan result)
+	go func() {
+		runtime.LockOSThread()
+		var res result
+		restored, err := withNamespaces(joins, fail, func() error {
+			defer func() {
+				if pval := recover(); pval != nil {
+					res.panicked, res.pval = true, pval
+				}
+			}()
+			return fn()
+		})
+		res.err = err
+		if restored {
+			runtime.UnlockOSThread()
+			done <- res
+			return
+		}
+		// This OS thread is stuck in the wrong namespaces, so we must not
+		// unlock it, in order to get rid of it when this goroutine ends.
+		done <- res
+		if keep && err == nil && !res.panicked {
+			select {}
+		}
+	}()
+	res := <-done
+	if res.panicked {
+		panic(res.pval)
+	}
+	return res.err
+}
+
+// withNamespaces joins the specified namespaces on the current (locked) OS
+// thread, runs fn, and then switches back into the original namespaces,
+// reporting whether it succeeded in switching back.
+//
+// Joining a mount namespace requires the OS thread to first stop sharing its
+// filesystem information, such as the current working directory, with the
+// other threads of the test process. As this cannot be undone, such an OS
+// thread never counts as switched back.
+func withNamespaces(joins []nsfile, fail func(NamespaceType, error) error, fn func() error) (restored bool, err error) {
+	var origs []nsfile
+	unshared := false
+	defer func() {
+		for _, orig := range origs {
+			orig.f.Close()
+		}
+	}()
+	for _, join := range joins {
+		f, err := os.Open(fmt.Sprintf("/proc/thread-self/ns/%s", join.typ))
+		if err != nil {
+			return restoreNamespaces(origs) && !unshared, fail(join.typ, err)
+		}
+		if join.typ == MountNS && !unshared {
+			if err := unix.Unshare(unix.CLONE_FS); err != nil {
+				f.Close()
+				return restoreNamespaces(origs), fail(join.typ, err)
+			}
+			unshared = true
+		}
+		if err := unix.Setns(int(join.f.Fd()), int(join.typ)); err != nil {
+			f.Close()
+			return restoreNamespaces(origs) && !unshared, fail(join.typ, err)
+		}
+		origs = append(origs, nsfile{typ: join.typ, f: f})
+	}
+	err = fn()
+	return restoreNamespaces(origs) && !unshared, err
+}
+
+// restoreNamespaces switches the current OS thread back into the specified
+// original namespaces, in reverse order, returning true if successful.
+func restoreNamespaces(origs []nsfile) bool {
+	for idx := len(origs) - 1; idx >= 0; idx-- {
+		if unix.Setns(int(origs[idx].f.Fd()), int(origs[idx].typ)) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// joinError returns a descriptive error about failing to join the namespace
+// of the specified type.
+func (cmd *TestCommand) joinError(t NamespaceType, err error) error {
+	return fmt.Errorf("TestCommand: cannot start %q in %s namespace of process %d, reason: %v%s",
+		cmd.path, t, cmd.joinpid, err, joinHint(err))
+}
+
+// joinHint returns a hint about why joining a namespace failed with the
+// specified error, if known.
+func joinHint(err error) string {
+	switch {
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return " (joining namespaces requires access to the process, as well as " +
+			"CAP_SYS_ADMIN in the user namespace owning the namespace; unprivileged " +
+			"test processes thus need to join this user namespace, too)"
+	case errors.Is(err, fs.ErrNotExist):
+		return " (the process doesn't exist (anymore), or the kernel doesn't support this type of namespace)"
+	}
+	return ""
+}
+
+// differingNamespaces returns the types of the namespaces of the specified
+// process which differ from the namespaces of the test process.
+func differingNamespaces(pid int) ([]NamespaceType, error) {
+	types := []NamespaceType{}
+	for _, nstype := range namespaceTypes {
+		own, err := os.Readlink("/proc/self/ns/" + nstype.name)
+		if err != nil {
+			continue // namespace type not supported.
+		}
+		other, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, nstype.name))
+		if err != nil {
+			return nil, fmt.Errorf("TestCommand: cannot determine namespaces of process %d, reason: %v",
+				pid, err)
+		}
+		if other != own {
+			types = append(types, nstype.typ)
+		}
+	}
+	return types, nil
+}
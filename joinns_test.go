@@ -0,0 +1,134 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"os"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("joining namespaces", func() {
+
+	It("starts commands in the namespaces of other commands", func() {
+		b := Basher{}
+		defer b.Done()
+		b.Script("ns", nsScript)
+		c1 := b.StartWith("ns", nil,
+			NewNamespaces(UserNS, MountNS, NetNS, UTSNS, IPCNS, PIDNS, CgroupNS, TimeNS), MapRoot())
+		defer c1.Close()
+		var ns1 map[string]interface{}
+		c1.Decode(&ns1)
+
+		c2 := b.StartIn(c1, "ns")
+		defer c2.Close()
+		var ns2 map[string]interface{}
+		c2.Decode(&ns2)
+		for _, t := range namespaceTypes {
+			Expect(ns2).To(HaveKeyWithValue(t.name, ns1[t.name]), t.name)
+		}
+		Expect(ns2).To(HaveKeyWithValue("self", Not(BeEquivalentTo(1))))
+		Expect(ns2).To(HaveKeyWithValue("uid", BeEquivalentTo(0)))
+		// Make sure that we didn't get stuck in the other namespaces.
+		for _, t := range []NamespaceType{NetNS, UTSNS, IPCNS, CgroupNS, PIDNS} {
+			Expect(ns2[t.String()]).NotTo(Equal(ownNamespace(t)))
+		}
+	})
+
+	It("follows the chain of single child processes", func() {
+		b := Basher{}
+		defer b.Done()
+		b.Script("outer", `unshare -Ufr --net --uts $inner`)
+		b.Script("inner", nsScript)
+		b.Script("ns", nsScript)
+		c1 := b.Start("outer")
+		defer c1.Close()
+		var ns1 map[string]interface{}
+		c1.Decode(&ns1)
+		Expect(ns1).To(HaveKeyWithValue("net", Not(Equal(ownNamespace(NetNS)))))
+
+		c2 := b.StartIn(c1, "ns")
+		defer c2.Close()
+		var ns2 map[string]interface{}
+		c2.Decode(&ns2)
+		Expect(ns2).To(HaveKeyWithValue("net", ns1["net"]))
+		Expect(ns2).To(HaveKeyWithValue("uts", ns1["uts"]))
+		Expect(ns2).To(HaveKeyWithValue("user", ns1["user"]))
+		Expect(ns2).To(HaveKeyWithValue("mnt", ownNamespace(MountNS)))
+	})
+
+	It("joins only the specified namespaces", func() {
+		c1 := NewTestCommandWith("/bin/bash", []string{"-c", nsScript},
+			NewNamespaces(UserNS, NetNS, UTSNS), MapRoot())
+		defer c1.Close()
+		var ns1 map[string]interface{}
+		c1.Decode(&ns1)
+
+		c2 := NewTestCommandWith("/bin/bash", []string{"-c", nsScript},
+			InNamespacesOf(c1.cmd.Process.Pid, NetNS))
+		defer c2.Close()
+		var ns2 map[string]interface{}
+		c2.Decode(&ns2)
+		Expect(ns2).To(HaveKeyWithValue("net", ns1["net"]))
+		Expect(ns2).To(HaveKeyWithValue("uts", ownNamespace(UTSNS)))
+		Expect(ns2).To(HaveKeyWithValue("user", ownNamespace(UserNS)))
+	})
+
+	It("joins user namespaces first and applies credentials afterwards", func() {
+		mapping := []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+			{ContainerID: 1000, HostID: 100000, Size: 1},
+		}
+		c1 := NewTestCommandWith("/bin/bash", []string{"-c", nsScript},
+			NewNamespaces(UserNS, NetNS), UIDMappings(mapping...), GIDMappings(mapping...))
+		defer c1.Close()
+		var ns1 map[string]interface{}
+		c1.Decode(&ns1)
+
+		c2 := NewTestCommandWith("/bin/bash", []string{"-c", nsScript},
+			InNamespacesOf(c1.cmd.Process.Pid, UserNS, NetNS),
+			func(cmd *TestCommand) {
+				// The user namespace denies setgroups, so keep the groups.
+				cmd.cmd.SysProcAttr.Credential = &syscall.Credential{
+					Uid: 1000, Gid: 1000, NoSetGroups: true}
+			})
+		defer c2.Close()
+		Expect(c2.cmd.Args).To(ContainElements("--user", "--net", HaveSuffix("setpriv"), "--reuid=1000"))
+		var ns2 map[string]interface{}
+		c2.Decode(&ns2)
+		Expect(ns2).To(HaveKeyWithValue("net", ns1["net"]))
+		Expect(ns2).To(HaveKeyWithValue("user", ns1["user"]))
+		Expect(ns2).To(HaveKeyWithValue("uid", BeEquivalentTo(1000)))
+	})
+
+	It("fails descriptively", func() {
+		Expect(func() {
+			NewTestCommandWith("/bin/true", nil, InNamespacesOf(-42, NetNS))
+		}).To(PanicWith(And(
+			ContainSubstring(`TestCommand: cannot start "/bin/true" in net namespace of process -42`),
+			ContainSubstring("doesn't exist"))))
+		Expect(func() {
+			NewTestCommandWith("/bin/true", nil, InNamespacesOf(-42))
+		}).To(PanicWith(ContainSubstring("cannot determine namespaces of process -42")))
+
+		cmd := &TestCommand{path: "/foo", joinpid: 42}
+		Expect(cmd.joinError(UserNS, syscall.EPERM)).To(MatchError(And(
+			HavePrefix(`TestCommand: cannot start "/foo" in user namespace of process 42, reason: `),
+			ContainSubstring("requires access to the process"))))
+	})
+
+})
@@ -0,0 +1,204 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/onsi/ginkgo/v2"
+	"golang.org/x/sys/unix"
+)
+
+// commandenv is the name of the environment variable tagging the processes
+// originating from a particular TestCommand.
+const commandenv = "TESTBASHER_COMMAND"
+
+// commandno numbers the TestCommands started, for tagging their processes.
+var commandno atomic.Uint64
+
+// unclosed keeps track of the TestCommands not yet closed.
+var unclosed = struct {
+	sync.Mutex
+	cmds map[*TestCommand]struct{}
+}{cmds: map[*TestCommand]struct{}{}}
+
+// UnclosedTestCommands returns descriptions of the TestCommands that have been
+// started, but not yet closed, including where they were started from. As
+// each Ginkgo parallel process has its own TestCommands, this is best checked
+// in an AfterSuite:
+//
+//	var _ = AfterSuite(func() {
+//	    Expect(testbasher.UnclosedTestCommands()).To(BeEmpty())
+//	})
+func UnclosedTestCommands() []string {
+	unclosed.Lock()
+	defer unclosed.Unlock()
+	descs := make([]string, 0, len(unclosed.cmds))
+	for cmd := range unclosed.cmds {
+		descs = append(descs, fmt.Sprintf("%s, started at %s",
+			strings.Join(append([]string{cmd.path}, cmd.args...), " "), cmd.origin))
+	}
+	sort.Strings(descs)
+	return descs
+}
+
+// Leaks returns the processes which originated from this TestCommand and which
+// were still alive after the command was closed, such as daemonized
+// processes. Leaks returns nil before the command has been closed. If the test
+// process is a child subreaper, then Close has already killed the leaked
+// processes; see BecomeSubreaper.
+func (cmd *TestCommand) Leaks() []Process {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	return cmd.leaks
+}
+
+// tag tags the environment of the command to be started with an identifier
+// unique to the command, which gets inherited by all processes originating
+// from the command, unless they deliberately clear their environment. This
+// allows attributing daemonized processes to their command, even after their
+// parents are gone.
+func (cmd *TestCommand) tag() {
+	cmd.tagvar = fmt.Sprintf("%s=%d-%d", commandenv, os.Getpid(), commandno.Add(1))
+	if cmd.cmd.Env == nil {
+		cmd.cmd.Env = os.Environ()
+	}
+	cmd.cmd.Env = append(cmd.cmd.Env, cmd.tagvar)
+}
+
+// tagged returns true if the environment of the specified process carries the
+// tag of the command.
+func (cmd *TestCommand) tagged(pid int) bool {
+	environ, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return false
+	}
+	for _, env := range bytes.Split(environ, []byte{0}) {
+		if string(env) == cmd.tagvar {
+			return true
+		}
+	}
+	return false
+}
+
+// originated returns true if the specified process provably originated from
+// the command, given the descendants of the command before closing it: the
+// process is either in the command's process group, or in a session of the
+// command or one of its descendants other than our session, or it carries the
+// command's tag. As a safeguard, tagged processes must not be older than the
+// command. Please note that processes adopted by us as a child subreaper after
+// their parents died might originate from any command, so being adopted alone
+// proves nothing.
+func (cmd *TestCommand) originated(ps procStat, tree map[int]procStat, ownsid int) bool {
+	return ps.pgrp == cmd.pgid ||
+		(ps.session != ownsid && (ps.session == cmd.sid || tree[ps.session].pid != 0)) ||
+		(ps.starttime >= cmd.starttime && cmd.tagged(ps.pid))
+}
+
+// started registers the freshly started command as unclosed, recording its
+// process group and session.
+func (cmd *TestCommand) started() {
+	pid := cmd.cmd.Process.Pid
+	cmd.pgid, _ = unix.Getpgid(pid)
+	cmd.sid, _ = unix.Getsid(pid)
+	cmd.starttime, _ = processStartTime(pid)
+	unclosed.Lock()
+	defer unclosed.Unlock()
+	unclosed.cmds[cmd] = struct{}{}
+}
+
+// closed unregisters the closed command and then checks for and reports
+// leaked processes, given the descendants of the command before closing it.
+func (cmd *TestCommand) closed(tree map[int]procStat) {
+	unclosed.Lock()
+	delete(unclosed.cmds, cmd)
+	unclosed.Unlock()
+	leaks := cmd.findLeaks(tree)
+	cmd.reap(leaks, tree, nil)
+	cmd.mu.Lock()
+	cmd.leaks = leaks
+	cmd.mu.Unlock()
+	what := "survived Close"
+	if subreaper.Load() || cmd.cgroup != "" {
+		what = "survived Close and got killed"
+	}
+	for _, leak := range leaks {
+		cmd.warnf("TestCommand: warning: process of %q started at %s %s: %s",
+			cmd.path, cmd.origin, what, leak)
+	}
+}
+
+// logTo makes the command log its warnings to the Basher's T, if set.
+func (b *Basher) logTo(cmd *TestCommand) {
+	cmd.t = b.T
+}
+
+// warnf logs the formatted warning to the test of the Basher that started the
+// command, if any, and otherwise writes it to the GinkgoWriter.
+func (cmd *TestCommand) warnf(format string, args ...interface{}) {
+	if cmd.t != nil {
+		cmd.t.Logf(format, args...)
+		return
+	}
+	fmt.Fprintf(ginkgo.GinkgoWriter, format+"\n", args...)
+}
+
+// findLeaks returns the processes still alive that either were descendants of
+// the command before closing it, or are members of the command's cgroup, or
+// otherwise provably originated from the command, as well as their
+// descendants. As processes might still be in the process of terminating,
+// findLeaks gives them a short grace period.
+func (cmd *TestCommand) findLeaks(tree map[int]procStat) []Process {
+	ownsid, _ := unix.Getsid(0)
+	for attempt := 1; ; attempt++ {
+		stats := procStats()
+		members := cgroupProcs(cmd.cgroup)
+		leaked := map[int]procStat{}
+		for pid, ps := range stats {
+			if pid == os.Getpid() {
+				continue
+			}
+			if old, ok := tree[pid]; ok && old.starttime == ps.starttime {
+				leaked[pid] = ps
+			} else if members[pid] || cmd.originated(ps, tree, ownsid) {
+				leaked[pid] = ps
+			}
+		}
+		for pid := range leaked {
+			for desc, ps := range descendants(stats, pid) {
+				leaked[desc] = ps
+			}
+		}
+		if len(leaked) == 0 {
+			return nil
+		}
+		if attempt == 5 {
+			leaks := make([]Process, 0, len(leaked))
+			for _, ps := range leaked {
+				leaks = append(leaks, ps.process())
+			}
+			sort.Slice(leaks, func(a, b int) bool { return leaks[a].PID < leaks[b].PID })
+			return leaks
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// kill kills the specified leaked processes.
+func kill(leaks []Process) {
+	for _, leak := range leaks {
+		_ = syscall.Kill(leak.PID, syscall.SIGKILL)
+	}
+}
+
+var _ = Describe("leaks", func() {
+
+	It("doesn't report well-behaved commands", func() {
+		c := NewTestCommand("/bin/bash", "-c", `sleep 0.1 & echo '"ok"' && read && wait`)
+		var s string
+		c.Decode(&s)
+		c.Close()
+		Expect(c.Leaks()).To(BeEmpty())
+	})
+
+	It("reports processes in new sessions", func() {
+		c := NewTestCommand("/bin/bash", "-c",
+			`setsid sleep 1001 </dev/null >/dev/null 2>&1 & echo '"ok"' && read`)
+		Expect(c.Leaks()).To(BeNil())
+		var s string
+		c.Decode(&s)
+		c.Close()
+		defer kill(c.Leaks())
+		Expect(c.Leaks()).To(ConsistOf(And(
+			HaveField("Comm", "sleep"),
+			HaveField("Cmdline", ConsistOf("sleep", "1001")),
+		)))
+		Expect(c.Leaks()[0].String()).To(MatchRegexp(`^PID \d+ \(sleep\): sleep 1001$`))
+	})
+
+	It("reports orphaned process group members", func() {
+		c := NewTestCommand("/bin/bash", "-c",
+			`( sleep 1002 </dev/null >/dev/null 2>&1 & ) ; echo '"ok"' && read`)
+		var s string
+		c.Decode(&s)
+		c.Close()
+		defer kill(c.Leaks())
+		Expect(c.Leaks()).To(ConsistOf(HaveField("Cmdline", ConsistOf("sleep", "1002"))))
+	})
+
+	It("logs leaks to the test of the Basher", func() {
+		t := &fakeT{}
+		b := Basher{T: t}
+		defer b.Done()
+		b.Script("script", `( sleep 1004 </dev/null >/dev/null 2>&1 & ) ; echo '"ok"' && read`)
+		c := b.Start("script")
+		var s string
+		c.Decode(&s)
+		c.Close()
+		defer kill(c.Leaks())
+		Expect(t.logs).To(ConsistOf(MatchRegexp(
+			`^TestCommand: warning: process of ".*/script\.sh" started at .* survived Close: PID \d+ \(sleep\): sleep 1004$`)))
+	})
+
+	It("tracks unclosed commands", func() {
+		c := NewTestCommand("/bin/bash", "-c", `read`)
+		Expect(UnclosedTestCommands()).To(ContainElement(MatchRegexp(
+			fmt.Sprintf(`^/bin/bash -c read, started at .*/leaks_test\.go:%d$`,
+				CurrentSpecReport().LineNumber()+1))))
+		c.Close()
+		Expect(UnclosedTestCommands()).NotTo(ContainElement(HavePrefix("/bin/bash -c read,")))
+	})
+
+})
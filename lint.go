@@ -0,0 +1,118 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bashfinding matches a finding reported by "bash -n", such as
+// "/tmp/foo.sh: line 42: syntax error: unexpected end of file".
+var bashfinding = regexp.MustCompile(`^(.+): line (\d+): (.*)$`)
+
+// shellcheckfinding matches a finding reported by "shellcheck -f gcc", such
+// as "/tmp/foo.sh:42:1: warning: foo is referenced but not assigned [SC2154]".
+var shellcheckfinding = regexp.MustCompile(`^(.+):(\d+):\d+: (.*)$`)
+
+// lint checks the specified script file for syntax errors using "bash -n",
+// as well as using shellcheck, if installed. It panics if there are any
+// findings, reporting them with their line numbers mapped back to the origin
+// of the script body, which starts after the specified number of header lines
+// in the script file. If origin is unknown, findings refer to the script file
+// itself.
+//
+// As scripts may reference the variables of other scripts and files added
+// only later, lint doesn't check scripts for referencing unassigned variables;
+// see lintVarRefs instead.
+func (b *Basher) lint(what, scriptpath string, headerlines int, origin location) {
+	out, _ := exec.Command("bash", "-n", scriptpath).CombinedOutput()
+	findings := lintFindings(bashfinding, out, what, scriptpath, headerlines, origin)
+	if shellcheck, err := exec.LookPath("shellcheck"); err == nil && len(findings) == 0 {
+		args := []string{"-s", "bash", "-f", "gcc", "-S", "warning", "-x", "-e", "SC1090,SC1091"}
+		if scriptpath == b.defspath {
+			// The definitions define variables only for use by other
+			// scripts, so don't complain about them being unused.
+			args = append(args, "-e", "SC2034")
+		} else {
+			args = append(args, "-e", "SC2154")
+		}
+		out, _ := exec.Command(shellcheck, append(args, scriptpath)...).CombinedOutput()
+		findings = lintFindings(shellcheckfinding, out, what, scriptpath, headerlines, origin)
+	}
+	if len(findings) > 0 {
+		panic(fmt.Errorf("Basher: %s fails linting:\n\t%s",
+			what, strings.Join(findings, "\n\t")))
+	}
+}
+
+// lintVarRefs checks the scripts added since the last check for referencing
+// variables that aren't assigned, using shellcheck, if installed. As this
+// check needs the definitions of all scripts, files and variables, it is
+// done only when starting a script. lintVarRefs panics if there are any
+// findings; see also lint.
+func (b *Basher) lintVarRefs() {
+	names := make([]string, 0, len(b.scripts))
+	for name, s := range b.scripts {
+		if s.lintvarrefs {
+			names = append(names, name)
+		}
+	}
+	shellcheck, err := exec.LookPath("shellcheck")
+	if err != nil || len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := b.scripts[name]
+		s.lintvarrefs = false
+		what := fmt.Sprintf("script %q", name)
+		out, _ := exec.Command(shellcheck,
+			"-s", "bash", "-f", "gcc", "-x", "-i", "SC2154", s.path).CombinedOutput()
+		if findings := lintFindings(shellcheckfinding, out, what, s.path, 2, s.origin); len(findings) > 0 {
+			panic(fmt.Errorf("Basher: %s fails linting:\n\t%s",
+				what, strings.Join(findings, "\n\t")))
+		}
+	}
+}
+
+// lintFindings returns the findings in the specified linter output, with the
+// line numbers of findings matched by the specified expression mapped back to
+// the origin of the script body; see lint for details.
+func lintFindings(re *regexp.Regexp, out []byte, what, scriptpath string, headerlines int, origin location) []string {
+	var findings []string
+	for _, finding := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		m := re.FindStringSubmatch(finding)
+		if m == nil {
+			if finding != "" {
+				findings = append(findings, finding)
+			}
+			continue
+		}
+		file, line := m[1], m[2]
+		lineno, _ := strconv.Atoi(line)
+		if file != scriptpath || origin.file == "" || lineno <= headerlines {
+			findings = append(findings, file+":"+line+": "+m[3])
+			continue
+		}
+		findings = append(findings, fmt.Sprintf("%s (%s line %d): %s",
+			origin.offset(lineno-headerlines-1), what, lineno-headerlines, m[3]))
+	}
+	return findings
+}
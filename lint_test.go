@@ -0,0 +1,85 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os/exec"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Basher linting", func() {
+
+	It("accepts good scripts", func() {
+		b := Basher{Lint: true}
+		defer b.Done()
+
+		Expect(func() {
+			b.Common(`FOO=42`)
+			b.Var("BAR", "42")
+			b.Script("good", `echo "\"$FOO$BAR\""`)
+		}).NotTo(Panic())
+	})
+
+	It("maps syntax errors back to the Go caller", func() {
+		b := Basher{Lint: true}
+		defer b.Done()
+
+		line := caller(0).line + 1
+		Expect(func() { b.Script("bad", "\necho\necho )") }).To(PanicWith(MatchError(
+			MatchRegexp(fmt.Sprintf(
+				`^Basher: script "bad" fails linting:\n\t.*/lint_test\.go:%d \(script "bad" line 3\): syntax error`,
+				line+2)))))
+	})
+
+	It("checks variable references only when starting scripts", func() {
+		if _, err := exec.LookPath("shellcheck"); err != nil {
+			Skip("shellcheck not installed")
+		}
+		b := Basher{Lint: true}
+		defer b.Done()
+
+		Expect(func() {
+			b.Script("script", `$other`)
+			b.Script("other", `echo "\"$FOO\"" && read`)
+			b.Var("FOO", "foo")
+		}).NotTo(Panic())
+		cmd := b.Start("script")
+		defer cmd.Close()
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal("foo"))
+
+		b.Script("bad", `echo "$nada"`)
+		Expect(func() { b.Start("bad") }).To(PanicWith(MatchError(
+			MatchRegexp(`^Basher: script "bad" fails linting:\n\t.*/lint_test\.go:\d+ \(script "bad" line 1\): .*nada.*SC2154`))))
+	})
+
+	It("maps syntax errors back to script files", func() {
+		b := Basher{Lint: true}
+		defer b.Done()
+
+		Expect(func() {
+			b.ScriptsFrom(fstest.MapFS{
+				"bad.sh": {Data: []byte("#!/bin/bash\necho )\n")},
+			}, "*.sh")
+		}).To(PanicWith(MatchError(
+			MatchRegexp(`^Basher: script "bad" fails linting:\n\tbad\.sh:2 \(script "bad" line 1\): syntax error`))))
+	})
+
+})
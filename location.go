@@ -0,0 +1,50 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// location is a position in a (Go) source or script file, telling where a
+// script originates from.
+type location struct {
+	file string
+	line int
+}
+
+// String returns the location in the usual "file:line" format.
+func (l location) String() string {
+	if l.file == "" {
+		return "<unknown>"
+	}
+	return fmt.Sprintf("%s:%d", l.file, l.line)
+}
+
+// offset returns the location the specified number of lines further down.
+func (l location) offset(lines int) location {
+	return location{file: l.file, line: l.line + lines}
+}
+
+// caller returns the location of the caller, skipping the specified number of
+// stack frames above the caller of caller.
+func caller(skip int) location {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return location{}
+	}
+	return location{file: file, line: line}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// NamespaceType identifies a type of Linux namespace, using the kernel's
+// CLONE_NEW* constants.
+type NamespaceType uint64
+
+// The types of Linux namespaces.
+const (
+	MountNS  NamespaceType = unix.CLONE_NEWNS     // mount namespace.
+	CgroupNS NamespaceType = unix.CLONE_NEWCGROUP // cgroup namespace.
+	UTSNS    NamespaceType = unix.CLONE_NEWUTS    // UTS (host and domain name) namespace.
+	IPCNS    NamespaceType = unix.CLONE_NEWIPC    // IPC namespace.
+	UserNS   NamespaceType = unix.CLONE_NEWUSER   // user namespace.
+	PIDNS    NamespaceType = unix.CLONE_NEWPID    // PID namespace.
+	NetNS    NamespaceType = unix.CLONE_NEWNET    // network namespace.
+	TimeNS   NamespaceType = unix.CLONE_NEWTIME   // time namespace.
+)
+
+// namespaceTypes lists all namespace types in the order the kernel's
+// nsenter(1) enters them, with their names as used in /proc/[PID]/ns.
+var namespaceTypes = []struct {
+	typ  NamespaceType
+	name string
+}{
+	{UserNS, "user"},
+	{CgroupNS, "cgroup"},
+	{IPCNS, "ipc"},
+	{UTSNS, "uts"},
+	{NetNS, "net"},
+	{PIDNS, "pid"},
+	{MountNS, "mnt"},
+	{TimeNS, "time"},
+}
+
+// String returns the name of the namespace type, as used in /proc/[PID]/ns,
+// such as “net” or “mnt”.
+func (t NamespaceType) String() string {
+	for _, nstype := range namespaceTypes {
+		if nstype.typ == t {
+			return nstype.name
+		}
+	}
+	return fmt.Sprintf("NamespaceType(%#x)", uint64(t))
+}
+
+// namespaceNames returns the names of the specified namespace types, separated
+// by commas.
+func namespaceNames(types []NamespaceType) string {
+	names := make([]string, len(types))
+	for idx, t := range types {
+		names[idx] = t.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// NewNamespaces starts the command in new namespaces of the specified types,
+// so that it runs inside them right from the start, instead of having to
+// “unshare” itself. Unless the test process is sufficiently privileged,
+// NewNamespaces needs to include a new user namespace, usually together with
+// MapRoot.
+//
+// New mount namespaces get their mount propagation set to private, so that
+// mounts inside them never propagate back. New time namespaces require Linux
+// 5.6 or later.
+func NewNamespaces(types ...NamespaceType) StartOption {
+	return func(cmd *TestCommand) {
+		for _, t := range types {
+			switch t {
+			case MountNS, TimeNS:
+				// Go's unsharing of mount namespaces takes care of making
+				// the mount propagation private. And the time namespace can
+				// only be unshared, as its flag clashes with clone's exit
+				// signal bits; the unsharing process then enters the new
+				// time namespace with the execve().
+				cmd.cmd.SysProcAttr.Unshareflags |= uintptr(t)
+			case CgroupNS, UTSNS, IPCNS, UserNS, PIDNS, NetNS:
+				cmd.cmd.SysProcAttr.Cloneflags |= uintptr(t)
+			default:
+				panic(fmt.Errorf("TestCommand: invalid namespace type %s", t))
+			}
+			cmd.namespaces = append(cmd.namespaces, t)
+		}
+	}
+}
+
+// UIDMappings maps user IDs inside a new user namespace to user IDs outside
+// it; see also NewNamespaces and MapRoot.
+func UIDMappings(mappings ...syscall.SysProcIDMap) StartOption {
+	return func(cmd *TestCommand) {
+		cmd.cmd.SysProcAttr.UidMappings = append(cmd.cmd.SysProcAttr.UidMappings, mappings...)
+	}
+}
+
+// GIDMappings maps group IDs inside a new user namespace to group IDs outside
+// it; see also NewNamespaces and MapRoot. As unprivileged processes can only
+// map group IDs with the setgroups syscall disabled, it gets always disabled.
+func GIDMappings(mappings ...syscall.SysProcIDMap) StartOption {
+	return func(cmd *TestCommand) {
+		cmd.cmd.SysProcAttr.GidMappings = append(cmd.cmd.SysProcAttr.GidMappings, mappings...)
+	}
+}
+
+// MapRoot maps the user and group IDs of the test process to root inside a
+// new user namespace, similar to “unshare -r”.
+func MapRoot() StartOption {
+	return func(cmd *TestCommand) {
+		UIDMappings(syscall.SysProcIDMap{ContainerID: 0, HostID: os.Getuid(), Size: 1})(cmd)
+		GIDMappings(syscall.SysProcIDMap{ContainerID: 0, HostID: os.Getgid(), Size: 1})(cmd)
+	}
+}
+
+// startError returns the specified error from starting the command, with
+// details about creating new namespaces, if any.
+func (cmd *TestCommand) startError(err error) error {
+	if len(cmd.namespaces) == 0 {
+		return err
+	}
+	var hint string
+	switch {
+	case errors.Is(err, syscall.EPERM):
+		hint = "creating namespaces other than user namespaces requires CAP_SYS_ADMIN, " +
+			"so consider adding a new user namespace; otherwise unprivileged user " +
+			"namespaces might be disabled by the system"
+	case errors.Is(err, syscall.EINVAL):
+		hint = "the kernel might not support some of the namespace types"
+	case errors.Is(err, syscall.ENOSPC):
+		hint = "the maximum number of namespaces has been reached, see /proc/sys/user/max_*_namespaces"
+	case errors.Is(err, syscall.EUSERS):
+		hint = "the maximum nesting depth of user namespaces has been reached"
+	}
+	if hint != "" {
+		hint = " (" + hint + ")"
+	}
+	return fmt.Errorf("TestCommand: cannot start %q in new %s namespaces, reason: %w%s",
+		cmd.path, namespaceNames(cmd.namespaces), err, hint)
+}
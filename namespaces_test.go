@@ -0,0 +1,108 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// nsScript outputs the namespace identifiers of itself as a JSON object.
+const nsScript = `
+j() { printf '"%s": "%s"' "$1" "$(readlink "/proc/self/ns/$1")"; }
+echo "{$(j user), $(j mnt), $(j net), $(j uts), $(j ipc), $(j pid), $(j cgroup), $(j time), \"self\": $$, \"uid\": $(id -u)}"
+read
+`
+
+// ownNamespace returns the identifier of our own namespace of the specified
+// type.
+func ownNamespace(t NamespaceType) string {
+	id, err := os.Readlink("/proc/self/ns/" + t.String())
+	Expect(err).NotTo(HaveOccurred())
+	return id
+}
+
+var _ = Describe("new namespaces", func() {
+
+	It("names namespace types", func() {
+		Expect(NetNS.String()).To(Equal("net"))
+		Expect(MountNS.String()).To(Equal("mnt"))
+		Expect(NamespaceType(0).String()).To(Equal("NamespaceType(0x0)"))
+		Expect(namespaceNames([]NamespaceType{UserNS, TimeNS})).To(Equal("user, time"))
+	})
+
+	It("starts commands in new namespaces", func() {
+		c := NewTestCommandWith("/bin/bash", []string{"-c", nsScript},
+			NewNamespaces(UserNS, MountNS, NetNS, UTSNS, IPCNS, PIDNS, CgroupNS), MapRoot())
+		defer c.Close()
+		var ns map[string]interface{}
+		c.Decode(&ns)
+		for _, t := range []NamespaceType{UserNS, MountNS, NetNS, UTSNS, IPCNS, CgroupNS} {
+			Expect(ns).To(HaveKeyWithValue(t.String(), Not(Equal(ownNamespace(t)))), t.String())
+		}
+		Expect(ns).To(HaveKeyWithValue("time", ownNamespace(TimeNS)))
+		Expect(ns).To(HaveKeyWithValue("self", BeEquivalentTo(1)))
+		Expect(ns).To(HaveKeyWithValue("uid", BeEquivalentTo(0)))
+	})
+
+	It("starts commands in new time namespaces", func() {
+		if _, err := os.Stat("/proc/self/ns/time"); err != nil {
+			Skip("no time namespace support")
+		}
+		b := Basher{}
+		defer b.Done()
+		b.Script("ns", nsScript)
+		c := b.StartWith("ns", nil, NewNamespaces(UserNS, TimeNS), MapRoot())
+		defer c.Close()
+		var ns map[string]interface{}
+		c.Decode(&ns)
+		Expect(ns).To(HaveKeyWithValue("time", Not(Equal(ownNamespace(TimeNS)))))
+		Expect(ns).To(HaveKeyWithValue("net", ownNamespace(NetNS)))
+	})
+
+	It("maps user and group IDs", func() {
+		c := NewTestCommandWith("/bin/bash", []string{"-c",
+			`echo "[\"$(</proc/self/uid_map)\", \"$(</proc/self/gid_map)\"]" && read`},
+			NewNamespaces(UserNS),
+			UIDMappings(syscall.SysProcIDMap{ContainerID: 42, HostID: os.Getuid(), Size: 1}),
+			GIDMappings(syscall.SysProcIDMap{ContainerID: 666, HostID: os.Getgid(), Size: 1}))
+		defer c.Close()
+		var maps []string
+		c.Decode(&maps)
+		Expect(maps).To(HaveExactElements(
+			MatchRegexp(fmt.Sprintf(`^\s*42\s+%d\s+1$`, os.Getuid())),
+			MatchRegexp(fmt.Sprintf(`^\s*666\s+%d\s+1$`, os.Getgid()))))
+	})
+
+	It("explains failing to create namespaces", func() {
+		cmd := &TestCommand{}
+		Expect(cmd.startError(syscall.EPERM)).To(Equal(syscall.EPERM))
+		cmd = NewTestCommandWith("/bin/true", nil)
+		cmd.Close()
+		cmd.namespaces = []NamespaceType{NetNS}
+		Expect(cmd.startError(syscall.EPERM)).To(MatchError(And(
+			ContainSubstring(`cannot start "/bin/true" in new net namespaces`),
+			ContainSubstring("requires CAP_SYS_ADMIN"))))
+		Expect(func() { NewNamespaces(NamespaceType(1)) }).NotTo(Panic())
+		Expect(func() {
+			NewTestCommandWith("/bin/true", nil, NewNamespaces(NamespaceType(1)))
+		}).To(PanicWith(MatchError("TestCommand: invalid namespace type NamespaceType(0x1)")))
+	})
+
+})
@@ -0,0 +1,184 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"syscall"
+)
+
+// NamespaceHelpers contains bash helper functions for reporting namespaces
+// as JSON, which can be decoded into NamespaceRef values. Add them as a common
+// script using CommonNamed("namespace-helpers", testbasher.NamespaceHelpers).
+//
+//   - nsref TYPE [PID] outputs a reference to the namespace of the specified
+//     type, such as “net”, of the specified process, defaulting to the
+//     process calling it. Decode it into a NamespaceRef.
+//   - nsrefs [PID] outputs references to all namespaces of the specified
+//     process as a JSON object, with the namespace types as keys. Decode it
+//     into a map[NamespaceType]NamespaceRef.
+const NamespaceHelpers = `# Outputs a JSON reference to a namespace of a process.
+nsref() {
+    local dev ino
+    read -r dev ino < <(stat -L -c '%d %i' "/proc/${2:-self}/ns/$1") || return 1
+    printf '{"type":"%s","ino":%s,"dev":%s}' "$1" "$ino" "$dev"
+}
+# Outputs JSON references to all namespaces of a process.
+nsrefs() {
+    local sep="" nstype ns
+    printf '{'
+    for nstype in user cgroup ipc uts net pid mnt time; do
+        [[ -e "/proc/${1:-self}/ns/$nstype" ]] || continue
+        ns="$(nsref "$nstype" "${1:-self}")" || return 1
+        printf '%s"%s":%s' "$sep" "$nstype" "$ns"
+        sep=","
+    done
+    printf '}'
+}
+`
+
+// NamespaceRef references a namespace by its type and inode number, as well
+// as optionally the device number of the namespace filesystem. NamespaceRef
+// can be unmarshalled from JSON in several formats, as commonly reported by
+// scripts:
+//
+//   - textual references, as returned by “readlink /proc/self/ns/net”, such
+//     as "net:[4026531840]".
+//   - bare inode numbers, either as numbers or strings, such as 4026531840;
+//     the namespace type then is unknown.
+//   - objects, as output by the NamespaceHelpers, such as
+//     {"type":"net","ino":4026531840,"dev":4}.
+type NamespaceRef struct {
+	Type NamespaceType `json:"type,omitempty"` // zero if unknown.
+	Ino  uint64        `json:"ino"`            // inode number.
+	Dev  uint64        `json:"dev,omitempty"`  // device number; zero if unknown.
+}
+
+// nsreftext matches textual namespace references, such as "net:[4026531840]".
+var nsreftext = regexp.MustCompile(`^([a-z]+):\[(\d+)\]$`)
+
+// NamespaceOf returns the reference to the namespace of the specified type of
+// the process with the specified PID, including the device number.
+func NamespaceOf(pid int, t NamespaceType) (NamespaceRef, error) {
+	info, err := os.Stat(fmt.Sprintf("/proc/%d/ns/%s", pid, t))
+	if err != nil {
+		return NamespaceRef{}, err
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	return NamespaceRef{Type: t, Ino: stat.Ino, Dev: uint64(stat.Dev)}, nil
+}
+
+// String returns the textual representation of the namespace reference, as
+// used by “readlink /proc/self/ns/net”, or just the inode number if the
+// namespace type is unknown.
+func (r NamespaceRef) String() string {
+	if r.Type == 0 {
+		return strconv.FormatUint(r.Ino, 10)
+	}
+	return fmt.Sprintf("%s:[%d]", r.Type, r.Ino)
+}
+
+// SameAs returns true if both references reference the same namespace. Types
+// and device numbers only get compared if they are known in both references.
+func (r NamespaceRef) SameAs(other NamespaceRef) bool {
+	return r.Ino == other.Ino &&
+		(r.Type == 0 || other.Type == 0 || r.Type == other.Type) &&
+		(r.Dev == 0 || other.Dev == 0 || r.Dev == other.Dev)
+}
+
+// IsNamespaceOf returns true if the referenced namespace is the namespace of
+// the process with the specified PID. The namespace type must be known.
+func (r NamespaceRef) IsNamespaceOf(pid int) (bool, error) {
+	if r.Type == 0 {
+		return false, fmt.Errorf("cannot compare namespace %s of unknown type", r)
+	}
+	ns, err := NamespaceOf(pid, r.Type)
+	if err != nil {
+		return false, err
+	}
+	return r.SameAs(ns), nil
+}
+
+// UnmarshalJSON unmarshals a namespace reference in any of the supported
+// formats.
+func (r *NamespaceRef) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) > 0 && data[0] == '{':
+		type plain NamespaceRef // avoids recursion.
+		var ref plain
+		if err := json.Unmarshal(data, &ref); err != nil {
+			return err
+		}
+		*r = NamespaceRef(ref)
+		return nil
+	case len(data) > 0 && data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if m := nsreftext.FindStringSubmatch(s); m != nil {
+			var t NamespaceType
+			if err := t.UnmarshalText([]byte(m[1])); err != nil {
+				return err
+			}
+			ino, err := strconv.ParseUint(m[2], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid namespace reference %q", s)
+			}
+			*r = NamespaceRef{Type: t, Ino: ino}
+			return nil
+		}
+		ino, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid namespace reference %q", s)
+		}
+		*r = NamespaceRef{Ino: ino}
+		return nil
+	}
+	var ino uint64
+	if err := json.Unmarshal(data, &ino); err != nil {
+		return fmt.Errorf("invalid namespace reference %s", data)
+	}
+	*r = NamespaceRef{Ino: ino}
+	return nil
+}
+
+// MarshalText returns the name of the namespace type, such as “net”.
+func (t NamespaceType) MarshalText() ([]byte, error) {
+	for _, nstype := range namespaceTypes {
+		if nstype.typ == t {
+			return []byte(nstype.name), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid namespace type %#x", uint64(t))
+}
+
+// UnmarshalText sets the namespace type from its name, such as “net”.
+func (t *NamespaceType) UnmarshalText(text []byte) error {
+	for _, nstype := range namespaceTypes {
+		if nstype.name == string(text) {
+			*t = nstype.typ
+			return nil
+		}
+	}
+	return errors.New("invalid namespace type " + strconv.Quote(string(text)))
+}
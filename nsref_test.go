@@ -0,0 +1,111 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"encoding/json"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("namespace references", func() {
+
+	DescribeTable("unmarshals namespace references",
+		func(j string, expected NamespaceRef) {
+			var ref NamespaceRef
+			Expect(json.Unmarshal([]byte(j), &ref)).To(Succeed())
+			Expect(ref).To(Equal(expected))
+		},
+		Entry("textual", `"user:[4026531837]"`, NamespaceRef{Type: UserNS, Ino: 4026531837}),
+		Entry("number", `4026531837`, NamespaceRef{Ino: 4026531837}),
+		Entry("numeric string", `"4026531837"`, NamespaceRef{Ino: 4026531837}),
+		Entry("object", `{"type":"net","ino":4026531840,"dev":4}`,
+			NamespaceRef{Type: NetNS, Ino: 4026531840, Dev: 4}),
+	)
+
+	DescribeTable("rejects invalid namespace references",
+		func(j string) {
+			var ref NamespaceRef
+			Expect(json.Unmarshal([]byte(j), &ref)).NotTo(Succeed())
+		},
+		Entry("unknown type", `"foo:[42]"`),
+		Entry("garbage", `"foo"`),
+		Entry("negative", `-1`),
+		Entry("invalid object", `{"type":"foo","ino":42}`),
+		Entry("wrong type", `true`),
+	)
+
+	It("marshals and compares namespace references", func() {
+		ref := NamespaceRef{Type: MountNS, Ino: 42, Dev: 4}
+		Expect(ref.String()).To(Equal("mnt:[42]"))
+		Expect(NamespaceRef{Ino: 42}.String()).To(Equal("42"))
+		j, err := json.Marshal(ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(j)).To(Equal(`{"type":"mnt","ino":42,"dev":4}`))
+		_, err = json.Marshal(NamespaceRef{Type: NamespaceType(1)})
+		Expect(err).To(HaveOccurred())
+
+		Expect(ref.SameAs(NamespaceRef{Ino: 42})).To(BeTrue())
+		Expect(ref.SameAs(NamespaceRef{Type: MountNS, Ino: 42})).To(BeTrue())
+		Expect(ref.SameAs(NamespaceRef{Type: NetNS, Ino: 42})).To(BeFalse())
+		Expect(ref.SameAs(NamespaceRef{Ino: 42, Dev: 5})).To(BeFalse())
+		Expect(ref.SameAs(NamespaceRef{Ino: 666})).To(BeFalse())
+
+		own, err := NamespaceOf(os.Getpid(), NetNS)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(own.Dev).NotTo(BeZero())
+		Expect(own.IsNamespaceOf(os.Getpid())).To(BeTrue())
+		_, err = NamespaceRef{Ino: own.Ino}.IsNamespaceOf(os.Getpid())
+		Expect(err).To(MatchError(MatchRegexp(`^cannot compare namespace \d+ of unknown type$`)))
+		_, err = NamespaceOf(-42, NetNS)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports namespaces from scripts", func() {
+		b := Basher{Lint: true}
+		defer b.Done()
+		b.CommonNamed("namespace-helpers", NamespaceHelpers)
+		// Pad the output, as the MementoReader otherwise blocks on a first
+		// read of between 256 and 511 bytes.
+		b.Script("ns", `
+echo "[$(nsrefs), $(nsref net), \"$(readlink /proc/self/ns/net)\", $(stat -L -c %i /proc/self/ns/net)]$(printf '%512s' '')"
+read`)
+		c := b.StartWith("ns", nil, NewNamespaces(UserNS, NetNS), MapRoot())
+		defer c.Close()
+		var refs []json.RawMessage
+		c.Decode(&refs)
+		Expect(refs).To(HaveLen(4))
+
+		var all map[NamespaceType]NamespaceRef
+		Expect(json.Unmarshal(refs[0], &all)).To(Succeed())
+		Expect(all).To(HaveKey(UserNS))
+		for t, ref := range all {
+			Expect(ref.Type).To(Equal(t))
+			Expect(ref.IsNamespaceOf(c.cmd.Process.Pid)).To(BeTrue(), t.String())
+		}
+		own, _ := NamespaceOf(os.Getpid(), NetNS)
+		Expect(all[NetNS].SameAs(own)).To(BeFalse())
+		Expect(all[UTSNS].SameAs(all[NetNS])).To(BeFalse())
+
+		for _, j := range refs[1:] {
+			var ref NamespaceRef
+			Expect(json.Unmarshal(j, &ref)).To(Succeed())
+			Expect(ref.SameAs(all[NetNS])).To(BeTrue(), string(j))
+		}
+	})
+
+})
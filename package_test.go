@@ -11,3 +11,7 @@ func TestTestBasher(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "testbasher package")
 }
+
+var _ = AfterSuite(func() {
+	Expect(UnclosedTestCommands()).To(BeEmpty())
+})
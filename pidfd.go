@@ -0,0 +1,179 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// is64bit is 1 on 64-bit architectures, and 0 otherwise.
+const is64bit = ^uint(0) >> 63
+
+// cldExited is the si_code of children having exited, as opposed to having
+// been killed (CLD_EXITED).
+const cldExited = 1
+
+// childInfo is the siginfo_t filled in by waitid(2) for child processes, see
+// also sigaction(2). On 64-bit architectures, the union following the common
+// fields is padded to 8 bytes.
+type childInfo struct {
+	Signo  int32
+	_      int32 // si_errno, swapped with si_code on MIPS.
+	Code   int32
+	_      [is64bit]int32
+	Pid    int32
+	UID    uint32
+	Status int32
+	_      [128 - (6+is64bit)*4]byte
+}
+
+// PidFD returns a pidfd referring to the process of the command, or -1 if the
+// kernel doesn't support pidfds (Linux before 5.3) or the command has been
+// closed. In contrast to the PID, a pidfd never refers to another process
+// reusing the PID after the command has been reaped.
+//
+// Close waits for the command to terminate by polling its pidfd, then reaps it
+// and collects its exit status using the pidfd, and kills it using the pidfd
+// if it doesn't terminate in time. Only without a pidfd does Close fall back
+// to the PID of the command. Signal signals the command's process group
+// instead. The pidfd is owned by the TestCommand and gets closed by Close, so
+// please dup(2) it in order to keep it beyond Close.
+func (cmd *TestCommand) PidFD() int {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	return cmd.pidfd
+}
+
+// ExitCode returns the exit code of the command after Close, or -1 if the
+// command hasn't been closed yet or has been terminated by a signal, such as
+// when Close had to kill it.
+func (cmd *TestCommand) ExitCode() int {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	return cmd.exitcode
+}
+
+// openPidfd opens a pidfd for the just started command, if supported by the
+// kernel. As the command cannot have been reaped yet, its PID cannot have
+// been reused in the meantime.
+func (cmd *TestCommand) openPidfd() {
+	if pidfd, err := unix.PidfdOpen(cmd.cmd.Process.Pid, 0); err == nil {
+		cmd.pidfd = pidfd
+	}
+}
+
+// closePidfd closes the pidfd of the command, if any.
+func (cmd *TestCommand) closePidfd() {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	if cmd.pidfd >= 0 {
+		_ = unix.Close(cmd.pidfd)
+		cmd.pidfd = -1
+	}
+}
+
+// kill kills the command itself, using its pidfd if available.
+func (cmd *TestCommand) kill() {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	if cmd.pidfd >= 0 {
+		_ = unix.PidfdSendSignal(cmd.pidfd, unix.SIGKILL, nil, 0)
+		return
+	}
+	_ = cmd.cmd.Process.Kill()
+}
+
+// waitPidfd waits at most the specified time for the command to terminate by
+// polling its pidfd, and then reaps the command using waitid(P_PIDFD),
+// recording its exit code. waitPidfd returns false if the command hasn't
+// terminated in time.
+func (cmd *TestCommand) waitPidfd(timeout time.Duration) bool {
+	pidfd := cmd.PidFD()
+	fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := unix.Poll(fds, int(time.Until(deadline).Milliseconds()))
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil || n == 0 {
+			return false
+		}
+		break
+	}
+	var info childInfo
+	siginfo := (*unix.Siginfo)(unsafe.Pointer(&info))
+	err := unix.Waitid(unix.P_PIDFD, pidfd, siginfo, unix.WEXITED, nil)
+	if errors.Is(err, unix.EINVAL) {
+		// Linux 5.3 supports polling pidfds, but not yet waiting on them; as
+		// the command has terminated, but not been reaped, its PID cannot
+		// have been reused.
+		err = unix.Waitid(unix.P_PID, cmd.cmd.Process.Pid, siginfo, unix.WEXITED, nil)
+	}
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	cmd.reaped = true
+	if err == nil && info.Code == cldExited {
+		cmd.exitcode = int(info.Status)
+	}
+	return true
+}
+
+// waitCmd waits in the background for the exec.Cmd of the command to finish
+// copying the command's error output and to release its pipes, returning a
+// channel closed when done. Unless the command has already been reaped using
+// its pidfd, this reaps the command using its PID, recording its exit code.
+func (cmd *TestCommand) waitCmd() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.cmd.Wait()
+		cmd.mu.Lock()
+		if !cmd.reaped {
+			cmd.reaped = true
+			if cmd.cmd.ProcessState != nil {
+				cmd.exitcode = cmd.cmd.ProcessState.ExitCode()
+			}
+		}
+		cmd.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// exited returns true if the command has terminated, without reaping it.
+// Waiting on a pidfd requires Linux 5.4 or later; otherwise, exited falls
+// back to waiting on the PID, as the command cannot have been reaped before
+// Close.
+func (cmd *TestCommand) exited() bool {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	if cmd.reaped {
+		return true
+	}
+	var info unix.Siginfo
+	options := unix.WEXITED | unix.WNOHANG | unix.WNOWAIT
+	var err error = unix.EINVAL
+	if cmd.pidfd >= 0 {
+		err = unix.Waitid(unix.P_PIDFD, cmd.pidfd, &info, options, nil)
+	}
+	if errors.Is(err, unix.EINVAL) {
+		err = unix.Waitid(unix.P_PID, cmd.cmd.Process.Pid, &info, options, nil)
+	}
+	return err != nil || info.Signo != 0
+}
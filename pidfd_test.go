@@ -0,0 +1,96 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pidfds", func() {
+
+	It("provides a pidfd for the command", func() {
+		c := NewTestCommand("/bin/bash", "-c", `read`)
+		defer c.Close()
+		pidfd := c.PidFD()
+		if pidfd < 0 {
+			Skip("kernel lacks pidfd support")
+		}
+		fdinfo, err := os.ReadFile(fmt.Sprintf("/proc/self/fdinfo/%d", pidfd))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(fdinfo)).To(ContainSubstring(fmt.Sprintf("Pid:\t%d\n", c.cmd.Process.Pid)))
+		c.Close()
+		Expect(c.PidFD()).To(Equal(-1))
+	})
+
+	It("reports the exit code", func() {
+		c := NewTestCommand("/bin/bash", "-c", `echo '"exiting"'; exit 42`)
+		defer c.Close()
+		var s string
+		c.Decode(&s)
+		Eventually(c.State).Should(Equal(StateExited))
+		Expect(c.ExitCode()).To(Equal(-1))
+		c.Close()
+		Expect(c.ExitCode()).To(Equal(42))
+		Expect(c.State()).To(Equal(StateExited))
+	})
+
+	It("reaps the command using its pidfd", func() {
+		c := NewTestCommand("/bin/bash", "-c", `read; exit 42`)
+		defer c.Close()
+		if c.PidFD() < 0 {
+			Skip("kernel lacks pidfd support")
+		}
+		c.Close()
+		Expect(c.ExitCode()).To(Equal(42))
+		// As the command has already been reaped, the exec.Cmd cannot.
+		Expect(c.cmd.ProcessState).To(BeNil())
+	})
+
+	It("kills commands not terminating in time", func() {
+		c := NewTestCommand("/bin/bash", "-c", `exec sleep 1007`)
+		defer c.Close()
+		c.Close()
+		Expect(c.ExitCode()).To(Equal(-1))
+		Expect(c.State()).To(Equal(StateExited))
+	})
+
+	It("falls back to the PID without a pidfd", func() {
+		c := NewTestCommand("/bin/bash", "-c", `echo '"exiting"'; read; exit 42`)
+		defer c.Close()
+		c.closePidfd()
+		var s string
+		c.Decode(&s)
+		Expect(c.State()).To(Equal(StateRunning))
+		c.Proceed()
+		Eventually(c.State).Should(Equal(StateExited))
+		c.Close()
+		Expect(c.ExitCode()).To(Equal(42))
+	})
+
+	It("refuses to signal and freeze closed commands", func() {
+		c := NewTestCommand("/bin/bash", "-c", `read`)
+		c.Close()
+		Expect(c.ExitCode()).To(Equal(0))
+		Expect(c.Signal(0)).To(MatchError(HaveSuffix("reason: no such process")))
+		Expect(c.Freeze()).To(MatchError(MatchRegexp(
+			`^TestCommand: cannot freeze ".*", reason: no such process$`)))
+		Expect(c.Thaw()).To(MatchError(HaveSuffix("reason: no such process")))
+	})
+
+})
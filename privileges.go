@@ -0,0 +1,240 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// rlimit is a resource limit to apply to a TestCommand.
+type rlimit struct {
+	resource   int
+	soft, hard uint64
+}
+
+// prlimitflags maps resources to the corresponding prlimit(1) CLI flags.
+var prlimitflags = map[int]string{
+	unix.RLIMIT_AS:         "--as",
+	unix.RLIMIT_CORE:       "--core",
+	unix.RLIMIT_CPU:        "--cpu",
+	unix.RLIMIT_DATA:       "--data",
+	unix.RLIMIT_FSIZE:      "--fsize",
+	unix.RLIMIT_LOCKS:      "--locks",
+	unix.RLIMIT_MEMLOCK:    "--memlock",
+	unix.RLIMIT_MSGQUEUE:   "--msgqueue",
+	unix.RLIMIT_NICE:       "--nice",
+	unix.RLIMIT_NOFILE:     "--nofile",
+	unix.RLIMIT_NPROC:      "--nproc",
+	unix.RLIMIT_RSS:        "--rss",
+	unix.RLIMIT_RTPRIO:     "--rtprio",
+	unix.RLIMIT_RTTIME:     "--rttime",
+	unix.RLIMIT_SIGPENDING: "--sigpending",
+	unix.RLIMIT_STACK:      "--stack",
+}
+
+// Credential runs the command as the specified user and group, with the
+// specified supplementary groups, or without any supplementary groups if none
+// are specified. Scripts of a Basher started with Credential get made
+// readable and executable for all users.
+func Credential(uid, gid uint32, groups ...uint32) StartOption {
+	return func(cmd *TestCommand) {
+		cmd.cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    uid,
+			Gid:    gid,
+			Groups: append([]uint32{}, groups...),
+		}
+	}
+}
+
+// AmbientCaps runs the command with the specified ambient capabilities, such
+// as unix.CAP_NET_ADMIN, so that the command keeps these capabilities even
+// when run with a non-root Credential.
+func AmbientCaps(caps ...uintptr) StartOption {
+	return func(cmd *TestCommand) {
+		cmd.cmd.SysProcAttr.AmbientCaps = append(cmd.cmd.SysProcAttr.AmbientCaps, caps...)
+	}
+}
+
+// BoundingCaps restricts the capability bounding set of the command to the
+// specified capabilities, dropping all other capabilities for good. Without
+// any capabilities specified, the bounding set becomes empty.
+//
+// BoundingCaps requires the setpriv(1) command from util-linux, which then
+// also applies Credential and AmbientCaps in the correct order.
+func BoundingCaps(caps ...uintptr) StartOption {
+	return func(cmd *TestCommand) {
+		cmd.bounding = append([]uintptr{}, caps...)
+	}
+}
+
+// NoNewPrivileges runs the command with the “no_new_privs” bit set, so that
+// neither the command nor its children can gain privileges, such as through
+// setuid binaries or file capabilities.
+//
+// NoNewPrivileges requires the setpriv(1) command from util-linux, which then
+// also applies Credential and AmbientCaps in the correct order.
+func NoNewPrivileges() StartOption {
+	return func(cmd *TestCommand) {
+		cmd.nonewprivs = true
+	}
+}
+
+// Rlimit sets the soft and hard limits of the specified resource, such as
+// unix.RLIMIT_NOFILE, for the command; use unix.RLIM_INFINITY for no limit.
+// Please note that only a privileged test process can raise hard limits.
+//
+// Rlimit requires the prlimit(1) command from util-linux.
+func Rlimit(resource int, soft, hard uint64) StartOption {
+	return func(cmd *TestCommand) {
+		cmd.rlimits = append(cmd.rlimits, rlimit{resource: resource, soft: soft, hard: hard})
+	}
+}
+
+// shareScripts makes the temporary scripts of the Basher readable and
+// executable for all users in case the command is to be run with a different
+// Credential.
+func (b *Basher) shareScripts(cmd *TestCommand) {
+	if cmd.cmd.SysProcAttr.Credential == nil {
+		return
+	}
+	err := filepath.WalkDir(b.tmpdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.Chmod(path, info.Mode().Perm()|0055)
+	})
+	if err != nil {
+		panic(fmt.Errorf("Basher: cannot share scripts with other users, reason: %v", err))
+	}
+}
+
+// wrapPrivileges wraps the command into setpriv(1) and prlimit(1) calls as
+// necessary to apply the privilege-related start options. As prlimit might
+// need to raise hard limits and setpriv needs to drop capabilities from the
+// bounding set before switching credentials, both run with the privileges of
+// the test process. Thus, when combining resource limits with a Credential,
+// setpriv switches credentials after prlimit has applied the limits.
+func (cmd *TestCommand) wrapPrivileges() error {
+	if cmd.bounding != nil || cmd.nonewprivs ||
+		(len(cmd.rlimits) > 0 && cmd.cmd.SysProcAttr.Credential != nil) {
+		setpriv := append([]string{"setpriv"}, cmd.setprivCredential()...)
+		if cmd.bounding != nil {
+			setpriv = append(setpriv, "--bounding-set="+capList(cmd.bounding))
+		}
+		if cmd.nonewprivs {
+			setpriv = append(setpriv, "--no-new-privs")
+		}
+		if err := cmd.wrap(setpriv...); err != nil {
+			return err
+		}
+	}
+	if len(cmd.rlimits) > 0 {
+		prlimit := []string{"prlimit"}
+		for _, limit := range cmd.rlimits {
+			flag, ok := prlimitflags[limit.resource]
+			if !ok {
+				return fmt.Errorf("TestCommand: cannot start %q with unknown resource limit %d",
+					cmd.path, limit.resource)
+			}
+			prlimit = append(prlimit, flag+"="+rlimitValue(limit.soft)+":"+rlimitValue(limit.hard))
+		}
+		if err := cmd.wrap(prlimit...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setprivCredential returns the setpriv(1) arguments applying the Credential
+// and AmbientCaps start options, removing them from the system process
+// attributes of the command, so that setpriv applies them instead. As the
+// Linux kernel clears the parent-death signal when switching credentials,
+// setpriv then needs to set it (again).
+func (cmd *TestCommand) setprivCredential() []string {
+	attr := cmd.cmd.SysProcAttr
+	var setpriv []string
+	if cred := attr.Credential; cred != nil {
+		setpriv = append(setpriv,
+			"--reuid="+strconv.FormatUint(uint64(cred.Uid), 10),
+			"--regid="+strconv.FormatUint(uint64(cred.Gid), 10))
+		if attr.Pdeathsig != 0 {
+			setpriv = append(setpriv, "--pdeathsig="+unix.SignalName(attr.Pdeathsig))
+		}
+		switch {
+		case cred.NoSetGroups:
+			setpriv = append(setpriv, "--keep-groups")
+		case len(cred.Groups) == 0:
+			setpriv = append(setpriv, "--clear-groups")
+		default:
+			groups := make([]string, 0, len(cred.Groups))
+			for _, gid := range cred.Groups {
+				groups = append(groups, strconv.FormatUint(uint64(gid), 10))
+			}
+			setpriv = append(setpriv, "--groups="+strings.Join(groups, ","))
+		}
+		attr.Credential = nil
+	}
+	if len(attr.AmbientCaps) > 0 {
+		caps := capList(attr.AmbientCaps)
+		setpriv = append(setpriv, "--inh-caps="+caps, "--ambient-caps="+caps)
+		attr.AmbientCaps = nil
+	}
+	return setpriv
+}
+
+// wrap wraps the command into the specified command and its arguments, which
+// gets passed the command to run after a "--" argument.
+func (cmd *TestCommand) wrap(wrapper ...string) error {
+	path, err := exec.LookPath(wrapper[0])
+	if err != nil {
+		return fmt.Errorf("TestCommand: cannot start %q without %s, reason: %v",
+			cmd.path, wrapper[0], err)
+	}
+	cmd.cmd.Args = append(append(append(wrapper, "--"), cmd.cmd.Path), cmd.cmd.Args[1:]...)
+	cmd.cmd.Path = path
+	return nil
+}
+
+// capList returns the specified capabilities in the form of “-all,+cap_N,...”
+// understood by setpriv(1).
+func capList(caps []uintptr) string {
+	list := "-all"
+	for _, c := range caps {
+		list += ",+cap_" + strconv.FormatUint(uint64(c), 10)
+	}
+	return list
+}
+
+// rlimitValue returns the specified resource limit value in the form
+// understood by prlimit(1).
+func rlimitValue(value uint64) string {
+	if value == unix.RLIM_INFINITY {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value, 10)
+}
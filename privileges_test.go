@@ -0,0 +1,172 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// privileges is what a script reports about its credentials, capabilities,
+// and limits.
+type privileges struct {
+	UID        int    `json:"uid"`
+	GID        int    `json:"gid"`
+	Groups     string `json:"groups"`
+	Ambient    string `json:"ambient"`
+	Bounding   string `json:"bounding"`
+	NoNewPrivs string `json:"nonewprivs"`
+	NoFile     string `json:"nofile"`
+}
+
+const privilegesScript = `
+status() { sed -n "s/^$1:\s*//p" /proc/self/status; }
+echo "{\"uid\": $(id -u), \"gid\": $(id -g), \"groups\": \"$(id -G)\",
+  \"ambient\": \"$(status CapAmb)\", \"bounding\": \"$(status CapBnd)\",
+  \"nonewprivs\": \"$(status NoNewPrivs)\", \"nofile\": \"$(ulimit -Sn):$(ulimit -Hn)\"}"
+read
+`
+
+// requireRoot skips the test unless run as root and the specified commands
+// are available.
+func requireRoot(commands ...string) {
+	GinkgoHelper()
+	if os.Geteuid() != 0 {
+		Skip("needs root")
+	}
+	for _, command := range commands {
+		if _, err := exec.LookPath(command); err != nil {
+			Skip(err.Error())
+		}
+	}
+}
+
+var _ = Describe("privileges", func() {
+
+	It("runs scripts with different credentials and ambient capabilities", func() {
+		requireRoot()
+		b := Basher{}
+		defer b.Done()
+		b.Script("script", privilegesScript)
+		c := b.StartWith("script", nil,
+			Credential(65534, 65534, 65533),
+			AmbientCaps(unix.CAP_NET_ADMIN))
+		defer c.Close()
+		var p privileges
+		c.Decode(&p)
+		Expect(p.UID).To(Equal(65534))
+		Expect(p.GID).To(Equal(65534))
+		Expect(p.Groups).To(Equal("65534 65533"))
+		Expect(p.Ambient).To(Equal("0000000000001000"))
+		Expect(p.NoNewPrivs).To(Equal("0"))
+	})
+
+	It("runs scripts with bounding capabilities, no new privileges, and limits", func() {
+		requireRoot("setpriv", "prlimit")
+		b := Basher{}
+		defer b.Done()
+		b.Script("script", privilegesScript)
+		c := b.StartWith("script", nil,
+			Credential(65534, 65534),
+			AmbientCaps(unix.CAP_NET_ADMIN),
+			BoundingCaps(unix.CAP_NET_ADMIN, unix.CAP_NET_RAW),
+			NoNewPrivileges(),
+			Rlimit(unix.RLIMIT_NOFILE, 100, 200))
+		defer c.Close()
+		var p privileges
+		c.Decode(&p)
+		Expect(p).To(Equal(privileges{
+			UID:        65534,
+			GID:        65534,
+			Groups:     "65534",
+			Ambient:    "0000000000001000",
+			Bounding:   "0000000000003000",
+			NoNewPrivs: "1",
+			NoFile:     "100:200",
+		}))
+		Expect(c.cmd.Args).To(HaveExactElements(
+			"prlimit", "--nofile=100:200", "--",
+			HaveSuffix("/setpriv"), "--reuid=65534", "--regid=65534", "--clear-groups",
+			"--inh-caps=-all,+cap_12", "--ambient-caps=-all,+cap_12",
+			"--bounding-set=-all,+cap_12,+cap_13", "--no-new-privs", "--",
+			HaveSuffix("/script.sh")))
+	})
+
+	It("raises hard limits before switching credentials", func() {
+		requireRoot("setpriv", "prlimit")
+		var limit unix.Rlimit
+		Expect(unix.Getrlimit(unix.RLIMIT_NOFILE, &limit)).To(Succeed())
+		if limit.Max == unix.RLIM_INFINITY {
+			Skip("hard limit already unlimited")
+		}
+		// Raise the hard limit if we can, such as when having CAP_SYS_RESOURCE.
+		hard := limit.Max + 1
+		if exec.Command("prlimit", fmt.Sprintf("--nofile=100:%d", hard), "true").Run() != nil {
+			hard = limit.Max
+		}
+		b := Basher{}
+		defer b.Done()
+		b.Script("script", privilegesScript)
+		c := b.StartWith("script", nil,
+			Credential(65534, 65534),
+			Pdeathsig(syscall.SIGKILL),
+			Rlimit(unix.RLIMIT_NOFILE, 100, hard))
+		defer c.Close()
+		var p privileges
+		c.Decode(&p)
+		Expect(p.UID).To(Equal(65534))
+		Expect(p.NoFile).To(Equal(fmt.Sprintf("100:%d", hard)))
+		Expect(c.cmd.Args).To(HaveExactElements(
+			"prlimit", fmt.Sprintf("--nofile=100:%d", hard), "--",
+			HaveSuffix("/setpriv"), "--reuid=65534", "--regid=65534",
+			"--pdeathsig=SIGKILL", "--clear-groups", "--",
+			HaveSuffix("/script.sh")))
+	})
+
+	It("applies limits without privileges", func() {
+		if _, err := exec.LookPath("prlimit"); err != nil {
+			Skip(err.Error())
+		}
+		var limit unix.Rlimit
+		Expect(unix.Getrlimit(unix.RLIMIT_NOFILE, &limit)).To(Succeed())
+		c := NewTestCommandWith("/bin/bash", []string{"-c", `echo "\"$(ulimit -Sn):$(ulimit -Hn)\"" && read`},
+			Rlimit(unix.RLIMIT_NOFILE, 42, limit.Max))
+		defer c.Close()
+		var nofile string
+		c.Decode(&nofile)
+		Expect(nofile).To(Equal("42:" + rlimitValue(limit.Max)))
+	})
+
+	It("rejects unknown resource limits", func() {
+		Expect(func() {
+			_ = NewTestCommandWith("/bin/true", nil, Rlimit(666, 0, 0))
+		}).To(PanicWith(`TestCommand: cannot start "/bin/true" with unknown resource limit 666`))
+	})
+
+	It("reports missing helper commands", func() {
+		GinkgoT().Setenv("PATH", GinkgoT().TempDir())
+		Expect(func() {
+			_ = NewTestCommandWith("/bin/true", nil, NoNewPrivileges())
+		}).To(PanicWith(HavePrefix(`TestCommand: cannot start "/bin/true" without setpriv, reason: `)))
+	})
+
+})
@@ -0,0 +1,142 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Process describes a process found in the /proc filesystem.
+type Process struct {
+	PID     int      `json:"pid"`
+	PPID    int      `json:"ppid"`
+	Comm    string   `json:"comm"`    // process name, as in /proc/[PID]/comm.
+	Cmdline []string `json:"cmdline"` // command line, empty for kernel threads.
+}
+
+// String returns a textual description of the process, consisting of its PID,
+// name, and command line.
+func (p Process) String() string {
+	return fmt.Sprintf("PID %d (%s): %s", p.PID, p.Comm, strings.Join(p.Cmdline, " "))
+}
+
+// procStat contains the details of a process from /proc/[PID]/stat that we're
+// interested in.
+type procStat struct {
+	pid       int
+	comm      string
+	state     byte
+	ppid      int
+	pgrp      int
+	session   int
+	starttime uint64 // in clock ticks since system boot.
+}
+
+// readProcStat returns the details of the process with the specified PID.
+func readProcStat(pid int) (procStat, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStat{}, err
+	}
+	// The process name is in parentheses and may contain spaces as well as
+	// parentheses, so we need to look for the last closing parenthesis. The
+	// state then is the first field following it, and the start time the
+	// 20th field.
+	lpar := bytes.IndexByte(stat, '(')
+	rpar := bytes.LastIndexByte(stat, ')')
+	if lpar < 0 || rpar < lpar {
+		return procStat{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(stat[rpar+1:]))
+	if len(fields) < 20 || len(fields[0]) != 1 {
+		return procStat{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	ps := procStat{
+		pid:   pid,
+		comm:  string(stat[lpar+1 : rpar]),
+		state: fields[0][0],
+	}
+	for _, field := range []struct {
+		idx int
+		val *int
+	}{{1, &ps.ppid}, {2, &ps.pgrp}, {3, &ps.session}} {
+		if *field.val, err = strconv.Atoi(fields[field.idx]); err != nil {
+			return procStat{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+		}
+	}
+	if ps.starttime, err = strconv.ParseUint(fields[19], 10, 64); err != nil {
+		return procStat{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return ps, nil
+}
+
+// processStartTime returns the start time of the process with the specified
+// PID, in clock ticks since system boot.
+func processStartTime(pid int) (uint64, error) {
+	ps, err := readProcStat(pid)
+	return ps.starttime, err
+}
+
+// procStats returns the details of all (living) processes, indexed by PID.
+// Processes vanishing while scanning are silently skipped.
+func procStats() map[int]procStat {
+	entries, _ := os.ReadDir("/proc")
+	stats := make(map[int]procStat, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		ps, err := readProcStat(pid)
+		if err != nil || ps.state == 'Z' || ps.state == 'X' {
+			continue
+		}
+		stats[pid] = ps
+	}
+	return stats
+}
+
+// descendants returns the descendants of the process with the specified PID,
+// indexed by their PIDs.
+func descendants(stats map[int]procStat, pid int) map[int]procStat {
+	children := map[int][]int{}
+	for _, ps := range stats {
+		children[ps.ppid] = append(children[ps.ppid], ps.pid)
+	}
+	desc := map[int]procStat{}
+	todo := children[pid]
+	for len(todo) > 0 {
+		child := todo[0]
+		todo = todo[1:]
+		desc[child] = stats[child]
+		todo = append(todo, children[child]...)
+	}
+	return desc
+}
+
+// process returns the Process description for the specified process details.
+func (ps procStat) process() Process {
+	p := Process{PID: ps.pid, PPID: ps.ppid, Comm: ps.comm}
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", ps.pid)); err == nil {
+		if cmdline = bytes.TrimRight(cmdline, "\x00"); len(cmdline) > 0 {
+			p.Cmdline = strings.Split(string(cmdline), "\x00")
+		}
+	}
+	return p
+}
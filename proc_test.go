@@ -0,0 +1,59 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"os"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("processes", func() {
+
+	It("reads process details", func() {
+		ps, err := readProcStat(os.Getpid())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ps.pid).To(Equal(os.Getpid()))
+		Expect(ps.ppid).To(Equal(os.Getppid()))
+		Expect(ps.pgrp).NotTo(BeZero())
+		Expect(ps.starttime).NotTo(BeZero())
+
+		_, err = readProcStat(-1)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("finds descendants and their command lines", func() {
+		sleeper := exec.Command("/bin/bash", "-c", `exec -a "sl (ee) p" sleep 1003`)
+		Expect(sleeper.Start()).To(Succeed())
+		defer func() {
+			_ = sleeper.Process.Kill()
+			_ = sleeper.Wait()
+		}()
+		Eventually(func() []Process {
+			var ps []Process
+			for _, stat := range descendants(procStats(), os.Getpid()) {
+				ps = append(ps, stat.process())
+			}
+			return ps
+		}).Should(ContainElement(And(
+			HaveField("PID", sleeper.Process.Pid),
+			HaveField("PPID", os.Getpid()),
+			HaveField("Cmdline", ConsistOf("sl (ee) p", "1003")),
+		)))
+	})
+
+})
@@ -0,0 +1,239 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RefCheck specifies how a Basher reacts to scripts calling undefined scripts,
+// or to scripts calling each other in cycles.
+type RefCheck int
+
+const (
+	// RefCheckWarn writes warnings to the GinkgoWriter (or logs them to T),
+	// so they show up in case of a failing test, warning only once about each
+	// finding. This is the default.
+	RefCheckWarn RefCheck = iota
+	// RefCheckFail panics when starting a script.
+	RefCheckFail
+	// RefCheckOff doesn't check scripts at all.
+	RefCheckOff
+)
+
+// cmdseparators matches the separators between (simple) shell commands.
+var cmdseparators = regexp.MustCompile("&&|\\|\\||[;&|()`\n]")
+
+// varref matches a word consisting only of a (quoted) variable reference, such
+// as “$foo”, “${foo}”, or “"$foo"”.
+var varref = regexp.MustCompile(`^"?\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))"?$`)
+
+// assignment matches a word consisting of a variable assignment.
+var assignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\+?=`)
+
+// assigned matches (most) variable assignments in scripts.
+var assigned = regexp.MustCompile(`(?:^|[\s;&|(])([A-Za-z_][A-Za-z0-9_]*)\+?=`)
+
+// declared matches (most) variable declarations in scripts, as well as
+// variables being set by “read” and “for”.
+var declared = regexp.MustCompile(`(?:^|[\s;&|(])(?:local|declare|typeset|readonly|export|read|for)\s([^;&|\n]*)`)
+
+// cmdprefixes lists the keywords that may precede a command, but which aren't
+// commands themselves.
+var cmdprefixes = map[string]struct{}{
+	"!": {}, "{": {}, "}": {}, "do": {}, "elif": {}, "else": {}, "if": {},
+	"then": {}, "time": {}, "until": {}, "while": {},
+}
+
+// wrappers lists commands which are commonly used to run another command that
+// is passed as an argument, such as “unshare -Ufr $userns”.
+var wrappers = map[string]struct{}{
+	".": {}, "bash": {}, "chroot": {}, "env": {}, "exec": {}, "ip": {},
+	"nice": {}, "nohup": {}, "nsenter": {}, "runuser": {}, "setpriv": {},
+	"setsid": {}, "sh": {}, "source": {}, "strace": {}, "sudo": {},
+	"taskset": {}, "timeout": {}, "unshare": {}, "xargs": {},
+}
+
+// scriptcall is a call of another script via a variable reference.
+type scriptcall struct {
+	varname string // name of the variable referenced.
+	line    int    // line number in the script body, starting with 1.
+}
+
+// scriptcalls returns the variable references in the specified script body
+// that look like script calls; that is, references in command position, or
+// passed as arguments to typical command wrappers, such as “unshare”.
+func scriptcalls(body string) []scriptcall {
+	var calls []scriptcall
+	for idx, line := range strings.Split(body, "\n") {
+		line = stripComment(line)
+		for _, cmd := range cmdseparators.Split(line, -1) {
+			words := strings.Fields(cmd)
+			for len(words) > 0 {
+				if _, ok := cmdprefixes[words[0]]; !ok && !assignment.MatchString(words[0]) {
+					break
+				}
+				words = words[1:]
+			}
+			if len(words) == 0 {
+				continue
+			}
+			if _, ok := wrappers[words[0]]; !ok {
+				words = words[:1]
+			}
+			for _, word := range words {
+				if m := varref.FindStringSubmatch(word); m != nil {
+					calls = append(calls, scriptcall{varname: m[1] + m[2], line: idx + 1})
+					break
+				}
+			}
+		}
+	}
+	return calls
+}
+
+// stripComment removes a trailing comment from the specified line. It's a
+// simplistic approach that doesn't take quoting into account.
+func stripComment(line string) string {
+	for idx, r := range line {
+		if r == '#' && (idx == 0 || line[idx-1] == ' ' || line[idx-1] == '\t') {
+			return line[:idx]
+		}
+	}
+	return line
+}
+
+// checkRefs checks all scripts for calling undefined scripts, as well as for
+// scripts calling each other in cycles, reacting as specified by RefCheck.
+func (b *Basher) checkRefs(name string) {
+	if b.RefCheck == RefCheckOff {
+		return
+	}
+	findings := b.refFindings()
+	if len(findings) == 0 {
+		return
+	}
+	if b.RefCheck == RefCheckFail {
+		panic(fmt.Errorf("Basher: cannot run script %q, reason:\n\t%s",
+			name, strings.Join(findings, "\n\t")))
+	}
+	for _, finding := range findings {
+		if !b.warned[finding] {
+			b.warned[finding] = true
+			b.logf("Basher: warning: %s", finding)
+		}
+	}
+}
+
+// refFindings returns the findings about scripts calling undefined scripts,
+// as well as about scripts calling each other in cycles.
+func (b *Basher) refFindings() []string {
+	// Variables defined somewhere in the scripts might well be used to run
+	// commands, so we don't want to see them as undefined.
+	defined := map[string]bool{}
+	bodies := make([]string, 0, len(b.scripts)+len(b.commons))
+	for _, s := range b.scripts {
+		bodies = append(bodies, s.body)
+	}
+	for _, c := range b.commons {
+		bodies = append(bodies, c.body)
+	}
+	for _, body := range bodies {
+		for _, m := range assigned.FindAllStringSubmatch(body, -1) {
+			defined[m[1]] = true
+		}
+		for _, m := range declared.FindAllStringSubmatch(body, -1) {
+			for _, word := range strings.Fields(m[1]) {
+				defined[strings.SplitN(word, "=", 2)[0]] = true
+			}
+		}
+	}
+	undefined := func(varname string) bool {
+		if _, ok := b.vars[varname]; ok || defined[varname] {
+			return false
+		}
+		if _, ok := os.LookupEnv(varname); ok {
+			return false
+		}
+		_, ok := reservedvars[varname]
+		return !ok
+	}
+	// Maps script variable names back to their scripts.
+	scriptvars := map[string]string{}
+	for name := range b.scripts {
+		scriptvars[b.VarPrefix+allowednamechars.ReplaceAllString(name, "_")] = name
+	}
+	var findings []string
+	report := func(what string, origin location, calls []scriptcall) {
+		for _, call := range calls {
+			if undefined(call.varname) {
+				findings = append(findings, fmt.Sprintf(
+					"%s (%s line %d): calls undefined script $%s",
+					origin.offset(call.line-1), what, call.line, call.varname))
+			}
+		}
+	}
+	names := make([]string, 0, len(b.scripts))
+	for name := range b.scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	calls := map[string][]string{}
+	for _, name := range names {
+		s := b.scripts[name]
+		scalls := scriptcalls(s.body)
+		report(fmt.Sprintf("script %q", name), s.origin, scalls)
+		for _, call := range scalls {
+			if callee, ok := scriptvars[call.varname]; ok {
+				calls[name] = append(calls[name], callee)
+			}
+		}
+	}
+	for _, c := range b.commons {
+		report(fmt.Sprintf("common script %q", c.name), c.origin, scriptcalls(c.body))
+	}
+	// Finally check for scripts calling each other in cycles.
+	state := map[string]bool{} // false: in progress, true: done.
+	var visit func(name string, path []string)
+	visit = func(name string, path []string) {
+		path = append(path, name)
+		if done, ok := state[name]; ok {
+			if !done {
+				for idx := range path {
+					if path[idx] == name {
+						path = path[idx:]
+						break
+					}
+				}
+				findings = append(findings, fmt.Sprintf("scripts calling each other in cycle %s",
+					strings.Join(path, " → ")))
+			}
+			return
+		}
+		state[name] = false
+		for _, callee := range calls[name] {
+			visit(callee, path)
+		}
+		state[name] = true
+	}
+	for _, name := range names {
+		visit(name, nil)
+	}
+	return findings
+}
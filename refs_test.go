@@ -0,0 +1,99 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Basher script references", func() {
+
+	It("finds script calls", func() {
+		Expect(scriptcalls(`
+$foo arg # $nope
+if true; then "${bar}"; fi
+unshare -Ufr $baz && echo $nope
+FOO=bar ip netns exec foo $qux | cat
+echo "$nope" $nope ${nope}
+`)).To(HaveExactElements(
+			scriptcall{varname: "foo", line: 2},
+			scriptcall{varname: "bar", line: 3},
+			scriptcall{varname: "baz", line: 4},
+			scriptcall{varname: "qux", line: 5},
+		))
+	})
+
+	It("accepts defined script calls", func() {
+		b := Basher{RefCheck: RefCheckFail}
+		defer b.Done()
+
+		b.Var("helper", "/bin/true")
+		b.Script("foo", `
+cmd=/bin/true
+$cmd
+for c in /bin/true; do $c; done
+$helper
+unshare -Ufr $bar`)
+		b.Script("bar", "read")
+		cmd := b.Start("foo")
+		cmd.Close()
+	})
+
+	It("rejects undefined script calls", func() {
+		b := Basher{RefCheck: RefCheckFail}
+		defer b.Done()
+
+		line := caller(0).line + 1
+		b.Script("foo", "\nunshare -Ufr $usrns")
+		b.Script("userns", "")
+		Expect(func() { b.Start("foo") }).To(PanicWith(MatchError(MatchRegexp(fmt.Sprintf(
+			`^Basher: cannot run script "foo", reason:\n\t.*/refs_test\.go:%d \(script "foo" line 2\): calls undefined script \$usrns$`,
+			line+1)))))
+	})
+
+	It("rejects scripts calling each other in cycles", func() {
+		b := Basher{RefCheck: RefCheckFail}
+		defer b.Done()
+
+		b.Script("entry", "$a")
+		b.Script("a", "$b")
+		b.Script("b", "exec $a")
+		Expect(func() { b.Start("entry") }).To(PanicWith(MatchError(
+			"Basher: cannot run script \"entry\", reason:\n\tscripts calling each other in cycle a → b → a")))
+	})
+
+	It("only warns by default", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Script("foo", "$usrns")
+		Expect(func() { b.Start("foo").Close() }).NotTo(Panic())
+	})
+
+	It("warns only once about each finding", func() {
+		t := &fakeT{}
+		b := Basher{T: t}
+		defer b.Done()
+
+		b.Script("foo", "$usrns")
+		b.Start("foo").Close()
+		b.Start("foo").Close()
+		Expect(t.logs).To(ConsistOf(ContainSubstring("Basher: warning: ")))
+	})
+
+})
@@ -0,0 +1,64 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ScriptsFrom adds all “*.sh” script files matching the glob pattern in the
+// specified file system, such as an embed.FS or an os.DirFS("testdata"). Each
+// script is added under its base name, so “testdata/foo-bar.sh” becomes script
+// “foo-bar” with its script variable “$foo_bar”. Any shebang line already
+// present in a script file is stripped, as Basher injects its own header.
+//
+// ScriptsFrom panics if the glob pattern is malformed, if it doesn't match any
+// script files, or if a script file cannot be read. Errors about scripts
+// refer to their original file paths.
+func (b *Basher) ScriptsFrom(fsys fs.FS, glob string) {
+	b.init()
+	matches, err := fs.Glob(fsys, glob)
+	if err != nil {
+		panic(fmt.Errorf("Basher: invalid script glob %q, reason: %v", glob, err))
+	}
+	found := false
+	for _, match := range matches {
+		if path.Ext(match) != ".sh" {
+			continue
+		}
+		content, err := fs.ReadFile(fsys, match)
+		if err != nil {
+			panic(fmt.Errorf("Basher: cannot read script %q, reason: %v", match, err))
+		}
+		body := string(content)
+		origin := location{file: match, line: 1}
+		if strings.HasPrefix(body, "#!") {
+			if eol := strings.IndexByte(body, '\n'); eol >= 0 {
+				body = body[eol+1:]
+			} else {
+				body = ""
+			}
+			origin.line++
+		}
+		b.addScript(path.Base(match), body, origin)
+		found = true
+	}
+	if !found {
+		panic(fmt.Errorf("Basher: no scripts matching %q", glob))
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"os"
+	"path/filepath"
+	"testing/fstest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Basher scripts from files", func() {
+
+	fsys := fstest.MapFS{
+		"testdata/foo-bar.sh": {Data: []byte("#!/bin/sh\n$baz\nread\n")},
+		"testdata/baz.sh":     {Data: []byte(`echo "\"baz\""`)},
+		"testdata/README.md":  {Data: []byte("# nothing to see here")},
+	}
+
+	It("adds scripts from a file system", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.ScriptsFrom(fsys, "testdata/*")
+		Expect(b.scripts).To(HaveLen(2))
+		Expect(b.scripts).To(HaveKey("foo-bar"))
+		Expect(b.scripts).To(HaveKey("baz"))
+
+		script, err := os.ReadFile(filepath.Join(b.tmpdir, "foo-bar.sh"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(script)).NotTo(ContainSubstring("#!/bin/sh"))
+
+		cmd := b.Start("foo-bar")
+		defer cmd.Close()
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal("baz"))
+	})
+
+	It("rejects unmatched globs", func() {
+		b := Basher{}
+		defer b.Done()
+
+		Expect(func() { b.ScriptsFrom(fsys, "testdata/*.md") }).To(PanicWith(MatchError(
+			`Basher: no scripts matching "testdata/*.md"`)))
+		Expect(func() { b.ScriptsFrom(fsys, "[") }).To(Panic())
+	})
+
+	It("refers to the original script files", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Script("baz", "")
+		Expect(func() { b.ScriptsFrom(fsys, "testdata/*.sh") }).To(PanicWith(MatchError(
+			MatchRegexp(`^Basher: duplicate script name "baz" from testdata/baz.sh:1, already defined by .*/scriptsfrom_test.go:\d+$`))))
+	})
+
+})
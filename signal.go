@@ -0,0 +1,223 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CommandState is the state of a TestCommand and its process tree, as
+// returned by TestCommand.State.
+type CommandState int
+
+// The states of a TestCommand.
+const (
+	StateRunning CommandState = iota // command is running (or sleeping).
+	StateStopped                     // command and its process tree are stopped or frozen.
+	StateExited                      // command has terminated.
+)
+
+// String returns the name of the command state.
+func (s CommandState) String() string {
+	switch s {
+	case StateRunning:
+		return "running"
+	case StateStopped:
+		return "stopped"
+	case StateExited:
+		return "exited"
+	}
+	return fmt.Sprintf("CommandState(%d)", int(s))
+}
+
+// Signal sends the specified signal to the process group of the command, that
+// is, to the command as well as its children, unless they have moved into
+// process groups of their own. Once Close has been called, Signal fails
+// without sending any signal, as the process group might have been reused in
+// the meantime.
+func (cmd *TestCommand) Signal(sig syscall.Signal) error {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	err := error(syscall.ESRCH)
+	if !cmd.closing {
+		// As long as the command hasn't been reaped by Close, its process
+		// group cannot be reused.
+		err = unix.Kill(-cmd.pgid, sig)
+	}
+	if err != nil {
+		return fmt.Errorf("TestCommand: cannot signal %q with %s, reason: %w",
+			cmd.path, unix.SignalName(sig), err)
+	}
+	return nil
+}
+
+// Freeze stops the command and its process tree, waiting for all processes to
+// have stopped. For a command started InCgroup, Freeze uses the cgroup
+// freezer, which reliably stops all processes in the command's cgroup without
+// the processes noticing. Otherwise, Freeze sends SIGSTOP to the process group
+// of the command. Use Thaw to resume the command; Close automatically thaws a
+// frozen command. Once Close has been called, Freeze and Thaw fail.
+func (cmd *TestCommand) Freeze() error {
+	if err := cmd.freeze(true); err != nil {
+		return fmt.Errorf("TestCommand: cannot freeze %q, reason: %w", cmd.path, err)
+	}
+	return nil
+}
+
+// Thaw resumes the command and its process tree after Freeze.
+func (cmd *TestCommand) Thaw() error {
+	if err := cmd.freeze(false); err != nil {
+		return fmt.Errorf("TestCommand: cannot thaw %q, reason: %w", cmd.path, err)
+	}
+	return nil
+}
+
+// State returns whether the command is running, stopped or frozen together
+// with the other processes of its process group or cgroup, or has exited.
+func (cmd *TestCommand) State() CommandState {
+	if cmd.exited() {
+		return StateExited
+	}
+	if cmd.usesFreezer() {
+		if frozen, _ := cgroupFrozen(cmd.cgroup); frozen {
+			return StateStopped
+		}
+		return StateRunning
+	}
+	if cmd.groupStopped() {
+		return StateStopped
+	}
+	return StateRunning
+}
+
+// freeze freezes or thaws the command and then waits for the process tree of
+// the command to have reached the desired state.
+func (cmd *TestCommand) freeze(freeze bool) error {
+	cmd.mu.Lock()
+	if cmd.closing {
+		cmd.mu.Unlock()
+		return syscall.ESRCH
+	}
+	usesfreezer := cmd.usesFreezer()
+	var err error
+	if usesfreezer {
+		value := "0"
+		if freeze {
+			value = "1"
+		}
+		err = writeCgroupFile(cmd.cgroup, "cgroup.freeze", value)
+	} else {
+		sig := unix.SIGCONT
+		if freeze {
+			sig = unix.SIGSTOP
+		}
+		err = unix.Kill(-cmd.pgid, sig)
+	}
+	if err == nil {
+		cmd.frozen = freeze
+	}
+	cmd.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if usesfreezer {
+		return waitFor(func() (bool, error) {
+			frozen, err := cgroupFrozen(cmd.cgroup)
+			return frozen == freeze, err
+		})
+	}
+	return waitFor(func() (bool, error) {
+		return cmd.groupStopped() == freeze, nil
+	})
+}
+
+// thaw resumes the command if it has been frozen, ignoring any errors.
+func (cmd *TestCommand) thaw() {
+	cmd.mu.Lock()
+	frozen := cmd.frozen
+	cmd.mu.Unlock()
+	if frozen {
+		_ = cmd.freeze(false)
+	}
+}
+
+// usesFreezer returns true if the command is to be frozen using the cgroup
+// freezer.
+func (cmd *TestCommand) usesFreezer() bool {
+	if cmd.cgroup == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(cmd.cgroup, "cgroup.freeze"))
+	return err == nil
+}
+
+// groupStopped returns true if there are processes in the process group of
+// the command and all of them are stopped.
+func (cmd *TestCommand) groupStopped() bool {
+	members := 0
+	for _, ps := range procStats() {
+		if ps.pgrp != cmd.pgid {
+			continue
+		}
+		if ps.state != 'T' && ps.state != 't' {
+			return false
+		}
+		members++
+	}
+	return members > 0
+}
+
+// cgroupFrozen returns true if the specified cgroup has been frozen.
+func cgroupFrozen(dir string) (bool, error) {
+	events, err := os.Open(filepath.Join(dir, "cgroup.events"))
+	if err != nil {
+		return false, err
+	}
+	defer events.Close()
+	scanner := bufio.NewScanner(events)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "frozen "); ok {
+			return value == "1", nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// waitFor waits at most 2s for the specified condition to become true.
+func waitFor(cond func() (bool, error)) error {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ok, err := cond()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
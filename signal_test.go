@@ -0,0 +1,108 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("signalling and freezing", func() {
+
+	It("names command states", func() {
+		Expect(StateRunning.String()).To(Equal("running"))
+		Expect(StateStopped.String()).To(Equal("stopped"))
+		Expect(StateExited.String()).To(Equal("exited"))
+		Expect(CommandState(42).String()).To(Equal("CommandState(42)"))
+	})
+
+	It("signals the process group", func() {
+		b := Basher{}
+		defer b.Done()
+		b.Script("script", `
+trap 'echo "\"usr1\""; exit' USR1
+bash -c 'trap "exit" USR1; echo "\"ready\""; while true; do sleep 0.01; done'
+wait
+`)
+		c := b.Start("script")
+		defer c.Close()
+		var s string
+		c.Decode(&s)
+		Expect(s).To(Equal("ready"))
+		Expect(c.Signal(syscall.SIGUSR1)).To(Succeed())
+		c.Decode(&s)
+		Expect(s).To(Equal("usr1"))
+		Eventually(c.State).Should(Equal(StateExited))
+		c.Close()
+		Expect(c.Signal(syscall.SIGUSR1)).To(MatchError(MatchRegexp(
+			`^TestCommand: cannot signal ".*" with SIGUSR1, reason: no such process$`)))
+	})
+
+	It("doesn't consider commands frozen when freezing fails", func() {
+		c := &TestCommand{path: "/foo", pgid: 1 << 30}
+		Expect(c.Freeze()).To(MatchError(HavePrefix(`TestCommand: cannot freeze "/foo", reason: `)))
+		Expect(c.frozen).To(BeFalse())
+	})
+
+	DescribeTable("freezes and thaws commands",
+		func(cgroup bool) {
+			var opts []StartOption
+			if cgroup {
+				writableCgroup()
+				opts = append(opts, InCgroup(CgroupConfig{}))
+			}
+			b := Basher{}
+			defer b.Done()
+			b.Script("script", `
+(i=0; while true; do i=$((i+1)); echo $i > "$1"; sleep 0.01; done) &
+echo '"ready"'
+read
+kill $!
+`)
+			counter := filepath.Join(GinkgoT().TempDir(), "counter")
+			c := b.StartWith("script", []string{counter}, opts...)
+			defer c.Close()
+			var s string
+			c.Decode(&s)
+			count := func() string {
+				text, _ := os.ReadFile(counter)
+				return string(text)
+			}
+			Expect(c.State()).To(Equal(StateRunning))
+
+			Expect(c.Freeze()).To(Succeed())
+			Expect(c.State()).To(Equal(StateStopped))
+			frozen := count()
+			Consistently(count).WithTimeout(100 * time.Millisecond).Should(Equal(frozen))
+
+			Expect(c.Thaw()).To(Succeed())
+			Expect(c.State()).To(Equal(StateRunning))
+			Eventually(count).ShouldNot(Equal(frozen))
+
+			Expect(c.Freeze()).To(Succeed())
+			c.Close()
+			Expect(c.State()).To(Equal(StateExited))
+			Expect(c.Leaks()).To(BeEmpty())
+		},
+		Entry("using signals", false),
+		Entry("using the cgroup freezer", true),
+	)
+
+})
@@ -0,0 +1,148 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ownerfilename is the name of the marker file in each temporary directory,
+// recording the process owning the directory. This allows telling stale
+// directories left behind by crashed or killed test processes apart from
+// directories of other test processes still running.
+const ownerfilename = ".testbasher-owner"
+
+// keptmarker is the owner marker file content of temporary directories
+// deliberately kept for post-mortem debugging.
+const keptmarker = "kept"
+
+// unknownmarker is recorded in the owner marker file instead of the process
+// start time of the owner when the start time cannot be determined.
+const unknownmarker = "unknown"
+
+// RemoveStale removes the temporary Basher directories in the specified root
+// directory whose owning test processes don't exist anymore, such as when a
+// test binary got killed before it could call Done. If root is empty, then
+// $TESTBASHER_TMPDIR or otherwise the system's temporary directory is used.
+// Directories kept for post-mortem debugging are never removed, neither are
+// directories of owners in other PID namespaces, as their PIDs cannot be
+// checked from here. RemoveStale returns the paths of the removed directories.
+//
+// RemoveStale is meant to be called from TestMain or BeforeSuite.
+func RemoveStale(root string) ([]string, error) {
+	if root == "" {
+		root = TempRoot()
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("Basher: cannot remove stale temporary directories, reason: %v", err)
+	}
+	var removed []string
+	var errs []error
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		if !IsBasherDir(dir) {
+			continue
+		}
+		owner, err := os.ReadFile(filepath.Join(dir, ownerfilename))
+		if err != nil || !stale(string(owner)) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, dir)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return removed, fmt.Errorf("Basher: cannot remove stale temporary directories, reason: %v", err)
+	}
+	return removed, nil
+}
+
+// writeOwner writes the owner marker file into the temporary directory,
+// recording our PID, process start time (as PIDs get reused), and PID
+// namespace (as PIDs are meaningless outside it).
+func (b *Basher) writeOwner() {
+	pid := os.Getpid()
+	starttime := unknownmarker
+	if st, err := processStartTime(pid); err == nil {
+		starttime = strconv.FormatUint(st, 10)
+	}
+	pidns := unknownmarker
+	if ns, err := NamespaceOf(pid, PIDNS); err == nil {
+		pidns = strconv.FormatUint(ns.Ino, 10)
+	}
+	if err := os.WriteFile(filepath.Join(b.tmpdir, ownerfilename),
+		[]byte(fmt.Sprintf("%d %s %s\n", pid, starttime, pidns)), 0644); err != nil {
+		panic(fmt.Errorf("Basher: cannot mark temporary directory owner, reason: %v", err))
+	}
+}
+
+// markKept marks the specified temporary directory as deliberately kept, so
+// it never gets removed as a stale directory.
+func markKept(dir string) {
+	_ = os.WriteFile(filepath.Join(dir, ownerfilename), []byte(keptmarker+"\n"), 0644)
+}
+
+// IsKept returns true if the specified directory is a temporary Basher
+// directory deliberately kept for post-mortem debugging.
+func IsKept(dir string) bool {
+	owner, err := os.ReadFile(filepath.Join(dir, ownerfilename))
+	return err == nil && strings.TrimSpace(string(owner)) == keptmarker
+}
+
+// stale returns true if the owner process recorded in the specified owner
+// marker doesn't exist anymore. Owners with unknown start times are stale
+// only when their PID is gone, while owners in other (or unknown) PID
+// namespaces are never stale.
+func stale(owner string) bool {
+	fields := strings.Fields(owner)
+	if len(fields) != 3 {
+		return false // kept or garbled, so better leave it alone.
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return false
+	}
+	pidns, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return false
+	}
+	if ns, err := NamespaceOf(os.Getpid(), PIDNS); err != nil || ns.Ino != pidns {
+		return false
+	}
+	actual, err := processStartTime(pid)
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	if fields[1] == unknownmarker {
+		return false
+	}
+	starttime, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	return actual != starttime
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("stale temporary directories", func() {
+
+	It("marks temporary directories with their owner", func() {
+		b := Basher{TempDir: GinkgoT().TempDir()}
+		defer b.Done()
+		b.Script("foo", "")
+		owner, err := os.ReadFile(filepath.Join(b.tmpdir, ownerfilename))
+		Expect(err).NotTo(HaveOccurred())
+		starttime, err := processStartTime(os.Getpid())
+		Expect(err).NotTo(HaveOccurred())
+		pidns, err := NamespaceOf(os.Getpid(), PIDNS)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(owner)).To(Equal(fmt.Sprintf("%d %d %d\n", os.Getpid(), starttime, pidns.Ino)))
+		Expect(stale(string(owner))).To(BeFalse())
+		Expect(IsKept(b.tmpdir)).To(BeFalse())
+		markKept(b.tmpdir)
+		Expect(IsKept(b.tmpdir)).To(BeTrue())
+	})
+
+	It("removes only stale temporary directories", func() {
+		root := GinkgoT().TempDir()
+		pidns, err := NamespaceOf(os.Getpid(), PIDNS)
+		Expect(err).NotTo(HaveOccurred())
+		// Get the PID of a process that is gone by now.
+		sh := exec.Command("/bin/true")
+		Expect(sh.Run()).To(Succeed())
+		gone := sh.Process.Pid
+
+		// owned creates a new temporary directory with the specified owner.
+		owned := func(owner string) string {
+			b := Basher{TempDir: root}
+			b.Script("foo", "")
+			Expect(os.WriteFile(filepath.Join(b.tmpdir, ownerfilename),
+				[]byte(owner+"\n"), 0644)).To(Succeed())
+			return b.tmpdir
+		}
+
+		live := Basher{TempDir: root}
+		defer live.Done()
+		live.Script("foo", "")
+
+		kept := Basher{TempDir: root}
+		kept.Script("foo", "")
+		keptdir := kept.tmpdir
+		os.Setenv(keepenv, "1")
+		kept.Done()
+		os.Unsetenv(keepenv)
+		Expect(keptdir).To(BeADirectory())
+
+		deaddir := owned(fmt.Sprintf("%d 1 %d", gone, pidns.Ino))
+		reuseddir := owned(fmt.Sprintf("%d 1 %d", os.Getpid(), pidns.Ino))
+		unknowndeaddir := owned(fmt.Sprintf("%d unknown %d", gone, pidns.Ino))
+		unknownlivedir := owned(fmt.Sprintf("%d unknown %d", os.Getpid(), pidns.Ino))
+		otherpidnsdir := owned(fmt.Sprintf("%d 1 %d", gone, pidns.Ino+1))
+		unknownpidnsdir := owned(fmt.Sprintf("%d 1 unknown", gone))
+
+		Expect(os.Mkdir(filepath.Join(root, "other"), 0755)).To(Succeed())
+
+		removed, err := RemoveStale(root)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(ConsistOf(deaddir, reuseddir, unknowndeaddir))
+		Expect(live.tmpdir).To(BeADirectory())
+		Expect(keptdir).To(BeADirectory())
+		Expect(unknownlivedir).To(BeADirectory())
+		Expect(otherpidnsdir).To(BeADirectory())
+		Expect(unknownpidnsdir).To(BeADirectory())
+		Expect(filepath.Join(root, "other")).To(BeADirectory())
+	})
+
+	It("reports unusable root directories", func() {
+		_, err := RemoveStale("/nowhere")
+		Expect(err).To(MatchError(HavePrefix(
+			"Basher: cannot remove stale temporary directories, reason: ")))
+	})
+
+})
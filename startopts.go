@@ -0,0 +1,36 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import "syscall"
+
+// StartOption configures how a TestCommand gets started; see
+// NewTestCommandWith and Basher.StartWith.
+type StartOption func(*TestCommand)
+
+// Pdeathsig sends the started command the specified signal, such as SIGKILL,
+// when the test process dies, so the command doesn't outlive a crashed or
+// killed test binary. Please note that only the started command itself
+// receives the signal, but not its children, unless they set up their own
+// parent-death signal, as with “setpriv --pdeathsig”.
+//
+// As the Linux kernel actually sends the signal when the OS thread which
+// started the command terminates, the Go runtime may well send it too early
+// when a goroutine that locked its OS thread terminates without unlocking it.
+func Pdeathsig(sig syscall.Signal) StartOption {
+	return func(cmd *TestCommand) {
+		cmd.cmd.SysProcAttr.Pdeathsig = sig
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("start options", func() {
+
+	It("starts scripts with options", func() {
+		b := Basher{}
+		defer b.Done()
+		b.Script("script", `echo "$PPID" && read`)
+		c := b.StartWith("script", nil, Pdeathsig(syscall.SIGKILL))
+		defer c.Close()
+		var ppid int
+		c.Decode(&ppid)
+		Expect(ppid).To(Equal(os.Getpid()))
+		Expect(c.cmd.SysProcAttr.Pdeathsig).To(Equal(syscall.SIGKILL))
+		Expect(c.cmd.SysProcAttr.Setpgid).To(BeTrue())
+	})
+
+	It("signals the command when its parent dies", func() {
+		// The parent-death signal gets actually sent when the OS thread that
+		// started the command terminates, which is what we exploit here by
+		// never unlocking the thread.
+		cmds := make(chan *TestCommand)
+		go func() {
+			runtime.LockOSThread()
+			cmds <- NewTestCommandWith("/bin/bash", []string{"-c", `read`},
+				Pdeathsig(syscall.SIGKILL))
+		}()
+		c := <-cmds
+		defer c.Close()
+		Eventually(func() byte {
+			ps, _ := readProcStat(c.cmd.Process.Pid)
+			return ps.state
+		}).Should(Equal(byte('Z')))
+	})
+
+})
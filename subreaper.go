@@ -0,0 +1,82 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// subreaper is set once the test process has become a child subreaper.
+var subreaper atomic.Bool
+
+// BecomeSubreaper makes the test process a child subreaper, so that orphaned
+// processes, such as double-forked daemons started by scripts, get reparented
+// to the test process instead of the init process. This allows Close to not
+// only detect such leaked processes, but to also kill and reap them; see also
+// TestCommand.Leaks.
+//
+// BecomeSubreaper is meant to be called from TestMain or BeforeSuite. Please
+// note that the test process then becomes responsible for reaping orphaned
+// processes; TestCommand.Close reaps the processes originating from its
+// command.
+func BecomeSubreaper() error {
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("TestCommand: cannot become child subreaper, reason: %v", err)
+	}
+	subreaper.Store(true)
+	return nil
+}
+
+// reap kills the specified leaked processes and then reaps the processes
+// adopted by us which provably originated from the command, as long as we are
+// a child subreaper. Adopted processes originating from other commands are
+// left alone, as they are the business of their own commands. Additionally,
+// reap reaps the specified already killed processes, given by their PIDs.
+func (cmd *TestCommand) reap(leaks []Process, tree map[int]procStat, killed map[int]bool) {
+	if !subreaper.Load() {
+		return
+	}
+	if killed == nil {
+		killed = map[int]bool{}
+	}
+	for _, leak := range leaks {
+		if unix.Kill(leak.PID, unix.SIGKILL) == nil {
+			killed[leak.PID] = true
+		}
+	}
+	ownsid, _ := unix.Getsid(0)
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// Only reap killed or terminated processes, as otherwise we would
+		// block.
+		ps, err := readProcStat(pid)
+		if err != nil || ps.ppid != os.Getpid() || pid == cmd.cmd.Process.Pid ||
+			!(killed[pid] || (ps.state == 'Z' && cmd.originated(ps, tree, ownsid))) {
+			continue
+		}
+		var ws syscall.WaitStatus
+		_, _ = syscall.Wait4(pid, &ws, 0, nil)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("child subreaper", func() {
+
+	It("kills and reaps adopted daemons", func() {
+		Expect(BecomeSubreaper()).To(Succeed())
+		defer func() {
+			_ = unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 0, 0, 0, 0)
+			subreaper.Store(false)
+		}()
+
+		c := NewTestCommand("/bin/bash", "-c", `
+( setsid sleep 1005 </dev/null >/dev/null 2>&1 & echo "$!" )
+read
+`)
+		var pid int
+		c.Decode(&pid)
+		Eventually(func() int {
+			ps, _ := readProcStat(pid)
+			return ps.ppid
+		}).Should(Equal(os.Getpid()))
+		c.Close()
+		Expect(c.Leaks()).To(ConsistOf(HaveField("PID", pid)))
+		_, err := readProcStat(pid)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("leaves daemons of other commands alone", func() {
+		Expect(BecomeSubreaper()).To(Succeed())
+		defer func() {
+			_ = unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 0, 0, 0, 0)
+			subreaper.Store(false)
+		}()
+
+		daemon := func() (*TestCommand, int) {
+			c := NewTestCommand("/bin/bash", "-c", `
+( ( setsid sleep 1006 </dev/null >/dev/null 2>&1 & echo "$!" ) & wait )
+read
+`)
+			var pid int
+			c.Decode(&pid)
+			Eventually(func() int {
+				ps, _ := readProcStat(pid)
+				return ps.ppid
+			}).Should(Equal(os.Getpid()))
+			return c, pid
+		}
+		c1, pid1 := daemon()
+		defer c1.Close()
+		c2, pid2 := daemon()
+		defer c2.Close()
+
+		c1.Close()
+		Expect(c1.Leaks()).To(ConsistOf(HaveField("PID", pid1)))
+		_, err := readProcStat(pid1)
+		Expect(err).To(HaveOccurred())
+		_, err = readProcStat(pid2)
+		Expect(err).NotTo(HaveOccurred())
+
+		c2.Close()
+		Expect(c2.Leaks()).To(ConsistOf(HaveField("PID", pid2)))
+	})
+
+})
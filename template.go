@@ -0,0 +1,116 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Template adds a (BASH) script with the given name, rendering the script
+// from the specified text/template and data. Apart from this, Template behaves
+// exactly like Script. The template is parsed immediately, but only executed
+// when starting a script, so it can reference scripts added after it.
+//
+// The template has the following functions available, in order to avoid
+// fragile string formatting of Go values into shell code:
+//
+//   - sh: single-quotes its argument for safe use as a single shell word,
+//     such as in {{ sh .Path }}. The argument can be a string, a fmt.Stringer,
+//     or a number or bool.
+//   - json: JSON-encodes its argument and then single-quotes it, such as in
+//     echo {{ json .Expected }}.
+//   - script: returns the path of another script, single-quoted; such as in
+//     {{ script "other" }}.
+//
+// Template panics with an error pointing to the Go caller if the template
+// cannot be parsed, and starting a script panics with such an error if the
+// template cannot be executed.
+func (b *Basher) Template(name, tmpl string, data interface{}) {
+	b.init()
+	origin := caller(1)
+	t, err := template.New(name).Funcs(b.templateFuncs()).Parse(tmpl)
+	if err != nil {
+		panic(fmt.Errorf("Basher: %s: invalid template for script %q, reason: %v",
+			origin, name, err))
+	}
+	b.addScript(name, "", origin)
+	s := b.scripts[strings.TrimSuffix(name, ".sh")]
+	s.tmpl = t
+	s.data = data
+}
+
+// templateFuncs returns the functions available to script templates.
+func (b *Basher) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"sh": func(v interface{}) (string, error) {
+			switch v := v.(type) {
+			case string:
+				return shellquote(v), nil
+			case fmt.Stringer:
+				return shellquote(v.String()), nil
+			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+				float32, float64, bool:
+				return shellquote(fmt.Sprint(v)), nil
+			}
+			return "", fmt.Errorf("sh: unsupported type %T", v)
+		},
+		"json": func(v interface{}) (string, error) {
+			j, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			return shellquote(string(j)), nil
+		},
+		"script": func(name string) (string, error) {
+			s, ok := b.scripts[strings.TrimSuffix(name, ".sh")]
+			if !ok {
+				return "", fmt.Errorf("unknown script %q", name)
+			}
+			return shellquote(s.path), nil
+		},
+	}
+}
+
+// renderTemplates executes the templates of all scripts added using Template
+// and not yet rendered, writing the rendered scripts. It panics with an error
+// referencing the caller of Template in case of problems.
+func (b *Basher) renderTemplates() {
+	names := make([]string, 0, len(b.scripts))
+	for name, s := range b.scripts {
+		if s.tmpl != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := b.scripts[name]
+		var script strings.Builder
+		if err := s.tmpl.Execute(&script, s.data); err != nil {
+			panic(fmt.Errorf("Basher: %s: invalid template for script %q, reason: %v",
+				s.origin, name, err))
+		}
+		s.tmpl, s.data = nil, nil
+		s.body = script.String()
+		writeScript(name, s.path, ". "+shellquote(b.defspath)+"\n"+s.body, os.O_TRUNC)
+		if b.Lint {
+			b.lint(fmt.Sprintf("script %q", name), s.path, 2, s.origin)
+		}
+	}
+}
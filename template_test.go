@@ -0,0 +1,96 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Basher templates", func() {
+
+	It("renders scripts from templates", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Script("other", `echo "\"other $1\""`)
+		b.Template("script", `
+echo {{ json .Greeting }}
+{{ script "other" }} {{ sh .Arg }}
+read`, struct {
+			Greeting string
+			Arg      string
+		}{
+			Greeting: `Hello, "World's" $HOME`,
+			Arg:      "it's",
+		})
+		cmd := b.Start("script")
+		defer cmd.Close()
+
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal(`Hello, "World's" $HOME`))
+		cmd.Decode(&s)
+		Expect(s).To(Equal("other it's"))
+	})
+
+	It("resolves scripts added later", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Template("script", `{{ script "other" }} {{ sh .Num }} {{ sh .Stringer }} && read`, struct {
+			Num      int
+			Stringer fmt.Stringer
+		}{
+			Num:      42,
+			Stringer: stringer("foo bar"),
+		})
+		b.Script("other", `echo "\"other $# $1 $2\""`)
+		cmd := b.Start("script")
+		defer cmd.Close()
+
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal("other 2 42 foo bar"))
+	})
+
+	It("reports template errors at the Go caller", func() {
+		b := Basher{}
+		defer b.Done()
+
+		Expect(func() { b.Template("script", `{{ .Foo`, nil) }).To(PanicWith(MatchError(
+			MatchRegexp(`^Basher: .*/template_test\.go:\d+: invalid template for script "script", reason: .*unclosed action`))))
+		b.Template("nada", `{{ script "nada-nada" }}`, nil)
+		Expect(func() { b.Start("nada") }).To(PanicWith(MatchError(
+			MatchRegexp(`^Basher: .*/template_test\.go:\d+: .* unknown script "nada-nada"`))))
+	})
+
+	It("rejects unsupported sh arguments", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Template("script", `{{ sh . }}`, []string{"foo"})
+		Expect(func() { b.Start("script") }).To(PanicWith(MatchError(
+			ContainSubstring(`sh: unsupported type []string`))))
+	})
+
+})
+
+// stringer is a fmt.Stringer for testing shell-quoting Stringers.
+type stringer string
+
+func (s stringer) String() string { return string(s) }
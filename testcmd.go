@@ -15,12 +15,15 @@
 package testbasher
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"strings"
 	"sync"
 	"syscall"
+	"testing"
 	"time"
 )
 
@@ -32,25 +35,94 @@ import (
 // multi-stage test command (see also the Proceed method).
 type TestCommand struct {
 	cmd       *exec.Cmd       // the underlying OS command.
+	path      string          // path of the command, as originally specified.
+	args      []string        // arguments of the command, as originally specified.
 	childout  io.ReadCloser   // command's stdout stream.
 	childin   io.WriteCloser  // command's stdin stream.
 	childerr  strings.Builder // any stderr output from the command.
 	dec       *Decoder        // (wrapped) JSON decoder for deserializing the command's stdout stream.
 	closeonce sync.Once
+	origin    location   // where the command was started from.
+	t         testing.TB // test to log warnings to, if any.
+	pgid      int        // process group of the command.
+	sid       int        // session of the command.
+	starttime uint64     // start time of the command, in clock ticks since boot.
+	tagvar    string     // environment variable tagging the command's processes.
+
+	namespaces []NamespaceType // types of new namespaces to start the command in.
+	joinpid    int             // process whose namespaces to join, if non-zero.
+	jointypes  []NamespaceType // types of namespaces to join; nil for all differing ones.
+
+	cgroupconfig *CgroupConfig // cgroup to create for the command, if non-nil.
+	cgroup       string        // directory of the command's own cgroup, if any.
+
+	bounding   []uintptr // capability bounding set, if non-nil.
+	nonewprivs bool      // set the no_new_privs bit.
+	rlimits    []rlimit  // resource limits to apply.
+
+	mu         sync.Mutex
+	transcript []Step    // interaction with the command so far.
+	leaks      []Process // processes surviving Close.
+	frozen     bool      // command has been frozen and not thawed since.
+	closing    bool      // Close has been called, so the command might be reaped.
+	reaped     bool      // command has been waited for and reaped.
+	exitcode   int       // exit code of the reaped command, or -1.
+	pidfd      int       // pidfd referring to the command, or -1.
 }
 
+// Step is a single step in the interaction between a test and its
+// TestCommand, as recorded in the transcript of the command.
+type Step struct {
+	// Op is the kind of step: StepTell and StepProceed for input sent to the
+	// command, and StepDecode for output decoded from the command.
+	Op string `json:"op"`
+	// Text sent to the command as part of a StepTell.
+	Text string `json:"text,omitempty"`
+	// Value decoded from the command as part of a StepDecode, re-encoded into
+	// JSON.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// The kinds of steps in the transcript of a TestCommand.
+const (
+	StepTell    = "tell"    // text input followed by ENTER sent to the command.
+	StepProceed = "proceed" // ENTER input sent to the command.
+	StepDecode  = "decode"  // JSON value decoded from the command's output.
+)
+
 // NewTestCommand starts a command with arguments and then allows to read JSON
 // data from the command and interact with the command in order to optionally
 // step it through multiple stages under full control of a test. See the
 // Decode and Proceed methods for details. When done, please Close a
 // TestCommand.
 func NewTestCommand(command string, args ...string) *TestCommand {
+	return newTestCommand(exec.Command(command, args...))
+}
+
+// NewTestCommandWith starts a command with arguments, configured by the
+// specified start options, such as Pdeathsig. Apart from the options,
+// NewTestCommandWith behaves exactly like NewTestCommand.
+func NewTestCommandWith(command string, args []string, opts ...StartOption) *TestCommand {
+	return newTestCommand(exec.Command(command, args...), opts...)
+}
+
+// newTestCommand starts the already prepared command, configured by the
+// specified start options, and returns a new TestCommand for it.
+func newTestCommand(c *exec.Cmd, opts ...StartOption) *TestCommand {
 	cmd := &TestCommand{
-		cmd: exec.Command(command, args...),
+		cmd:      c,
+		path:     c.Path,
+		args:     c.Args[1:],
+		exitcode: -1,
+		pidfd:    -1,
 	}
 	// Ensure that the test command and its children are in the same new
 	// process group, so they can be stopped together.
 	cmd.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	for _, opt := range opts {
+		opt(cmd)
+	}
+	cmd.tag()
 	// Get the stdin and stdout streams for the soon-to-be child test command.
 	childout, err := cmd.cmd.StdoutPipe()
 	if err != nil {
@@ -66,32 +138,83 @@ func NewTestCommand(command string, args ...string) *TestCommand {
 	// And finally get a JSON decoder for decoding the test commands output
 	// stream.
 	cmd.dec = NewDecoder(childout)
-	if err := cmd.cmd.Start(); err != nil {
+	if err := cmd.wrapPrivileges(); err != nil {
 		panic(err.Error())
 	}
+	cgroupdir, err := cmd.makeCgroup()
+	if err != nil {
+		panic(err.Error())
+	}
+	err = cmd.start()
+	if cgroupdir != nil {
+		cgroupdir.Close()
+	}
+	if err != nil {
+		if cmd.cgroup != "" {
+			_ = os.Remove(cmd.cgroup)
+		}
+		panic(cmd.startError(err).Error())
+	}
+	cmd.origin = caller(2) // skip us and NewTestCommand or Basher.Start.
+	cmd.openPidfd()
+	cmd.started()
 	return cmd
 }
 
-// Close completes the command by sending it an ENTER input and then closing the
-// input pipe to the command. Then close waits at most 2s for the command to
-// finish its business. If the command passes the timeout, then it will be
-// killed hard.
+// Close completes the command by thawing it if frozen, sending it an ENTER
+// input and then closing the input pipe to the command. Then close waits at
+// most 2s for the command to finish its business. If the command passes the
+// timeout, then it will be killed hard. Close waits for and kills the command
+// using its pidfd, if available; see PidFD.
+//
+// Close then checks for processes originating from the command which are still
+// alive, such as daemonized processes, reporting them to the GinkgoWriter (or
+// to the T of the Basher having started the command); see also Leaks. For a
+// command started InCgroup, Close finally kills all processes in the
+// command's cgroup and removes the cgroup.
 //
 // This method does nothing if the test command has already been closed or is in
 // the process of being closed.
 func (cmd *TestCommand) Close() {
 	cmd.closeonce.Do(func() {
+		tree := descendants(procStats(), cmd.cmd.Process.Pid)
+		defer cmd.removeCgroup()
+		defer cmd.closed(tree)
+		cmd.thaw()
+		cmd.mu.Lock()
+		cmd.closing = true
+		cmd.mu.Unlock()
 		cmd.Proceed()
 		cmd.childin.Close()
 		cmd.childout.Close()
-		done := make(chan error)
-		go func() { done <- cmd.cmd.Wait() }()
-		select {
-		case <-time.After(2 * time.Second):
-			// And if thou'rt unwilling...
-			_ = cmd.cmd.Process.Kill()
-		case <-done:
+		if cmd.PidFD() >= 0 {
+			if !cmd.waitPidfd(2 * time.Second) {
+				// And if thou'rt unwilling...
+				cmd.kill()
+				cmd.waitPidfd(500 * time.Millisecond)
+			}
+			// Release the pipes, unless leaked processes keep the error
+			// output open.
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-cmd.waitCmd():
+			}
+		} else {
+			done := cmd.waitCmd()
+			select {
+			case <-time.After(2 * time.Second):
+				// And if thou'rt unwilling...
+				cmd.kill()
+				// Give the killed command a chance to get reaped, unless
+				// leaked processes keep its output open.
+				select {
+				case <-time.After(500 * time.Millisecond):
+				case <-done:
+				}
+			case <-done:
+			}
 		}
+		cmd.closePidfd()
 	})
 }
 
@@ -107,16 +230,36 @@ func (cmd *TestCommand) Decode(v interface{}) {
 		panic(fmt.Sprintf("TestCommand.Decode panicked: %s\nchild process stderr: %s",
 			err, cmd.childerr.String()))
 	}
+	value, _ := json.Marshal(v)
+	cmd.record(Step{Op: StepDecode, Value: value})
 }
 
 // Proceed sends the test command an ENTER input. This should be interpreted
 // by the test command to advance into the next test phase for this command,
 // or to finally terminate gracefully.
 func (cmd *TestCommand) Proceed() {
+	cmd.record(Step{Op: StepProceed})
 	_, _ = cmd.childin.Write([]byte{'\n'})
 }
 
 // Tell send the test command some text input, followed by ENTER.
 func (cmd *TestCommand) Tell(what string) {
+	cmd.record(Step{Op: StepTell, Text: what})
 	_, _ = cmd.childin.Write(append([]byte(what), byte('\n')))
 }
+
+// Transcript returns the interaction with the test command so far, that is,
+// the input sent to the command as well as the values decoded from the
+// command's output, in order.
+func (cmd *TestCommand) Transcript() []Step {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	return append([]Step(nil), cmd.transcript...)
+}
+
+// record adds the specified step to the transcript of the test command.
+func (cmd *TestCommand) record(step Step) {
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	cmd.transcript = append(cmd.transcript, step)
+}
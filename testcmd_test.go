@@ -58,6 +58,7 @@ var _ = Describe("TestCommand", func() {
 			Fail("test command Close() not reacting within time limit")
 		case <-done:
 		}
+		Expect(c.ExitCode()).To(Equal(-1))
 	})
 
 	It("returns the commands stderr when decoding fails", func() {
@@ -0,0 +1,76 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// validvarname matches valid shell variable names.
+var validvarname = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// reservedvars lists shell variables which are essential to a shell's and its
+// child processes' proper operation, so we must never clobber them with
+// Basher-defined variables.
+var reservedvars = map[string]struct{}{}
+
+// reservedprefixes lists the prefixes of whole families of reserved shell
+// variables.
+var reservedprefixes = []string{"BASH_", "COMP_", "LC_", "LD_", "READLINE_"}
+
+// bashkeywords lists the reserved words of bash; while bash technically
+// accepts most of them as variable names, using them as such invites only
+// confusion.
+var bashkeywords = map[string]struct{}{}
+
+func init() {
+	for _, name := range strings.Fields(`
+BASH BASHOPTS CDPATH COLUMNS DIRSTACK ENV EPOCHREALTIME EPOCHSECONDS EUID
+FCEDIT FUNCNAME GLOBIGNORE GROUPS HISTCMD HISTCONTROL HISTFILE HISTFILESIZE
+HISTIGNORE HISTSIZE HISTTIMEFORMAT HOME HOSTNAME HOSTTYPE IFS INPUTRC LANG
+LINENO LINES LOGNAME MACHTYPE MAIL MAILCHECK MAILPATH OLDPWD OPTARG OPTERR
+OPTIND OSTYPE PATH PIPESTATUS POSIXLY_CORRECT PPID PROMPT_COMMAND PS0 PS1 PS2
+PS3 PS4 PWD RANDOM REPLY SECONDS SHELL SHELLOPTS SHLVL SRANDOM TERM TIMEFORMAT
+TMOUT TMPDIR TZ UID USER`) {
+		reservedvars[name] = struct{}{}
+	}
+	for _, keyword := range strings.Fields(`
+case coproc do done elif else esac fi for function if in select then time until
+while`) {
+		bashkeywords[keyword] = struct{}{}
+	}
+}
+
+// checkVarname returns an error if the specified name isn't a valid shell
+// variable name, or if it is a reserved shell variable or bash keyword.
+func checkVarname(name string) error {
+	if !validvarname.MatchString(name) {
+		return fmt.Errorf("%q is not a valid shell variable name", name)
+	}
+	if _, ok := reservedvars[name]; ok {
+		return fmt.Errorf("%q is a reserved shell variable", name)
+	}
+	for _, prefix := range reservedprefixes {
+		if strings.HasPrefix(name, prefix) {
+			return fmt.Errorf("%q is a reserved shell variable", name)
+		}
+	}
+	if _, ok := bashkeywords[name]; ok {
+		return fmt.Errorf("%q is a bash keyword", name)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Var defines a shell variable with the specified name and value, which is
+// then available to all (non-common) scripts. The value can be a string, any
+// integer type, a string slice (which becomes a bash array), or a string to
+// string map (which becomes a bash associative array). The value is properly
+// quoted, so it reaches the scripts intact, even if it contains spaces,
+// quotes, or other characters special to the shell.
+//
+// Please note that the variable name is taken as is, so VarPrefix does not
+// apply. Var panics if the name is not a valid shell variable name, if it is
+// reserved, or if it clashes with a script or another variable.
+func (b *Basher) Var(name string, value interface{}) {
+	b.init()
+	var def string
+	switch v := value.(type) {
+	case string:
+		def = name + "=" + shellquote(v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		def = fmt.Sprintf("%s=%d", name, v)
+	case []string:
+		elems := make([]string, len(v))
+		for idx, elem := range v {
+			elems[idx] = shellquote(elem)
+		}
+		def = name + "=(" + strings.Join(elems, " ") + ")"
+	case map[string]string:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		elems := make([]string, len(keys))
+		for idx, key := range keys {
+			elems[idx] = "[" + shellquote(key) + "]=" + shellquote(v[key])
+		}
+		def = "declare -A " + name + "=(" + strings.Join(elems, " ") + ")"
+	default:
+		panic(fmt.Errorf("Basher: unsupported type %T of variable %q", value, name))
+	}
+	b.claimVar(name, fmt.Sprintf("variable %q", name))
+	b.appendDefs(def)
+}
+
+// Env defines an exported environment variable with the specified name and
+// value. The variable is available not only to all (non-common) scripts, but
+// also to all their child processes, as well as to the commands started via
+// Start. As with Var, the name is taken as is and the value properly quoted.
+func (b *Basher) Env(name, value string) {
+	b.init()
+	b.claimVar(name, fmt.Sprintf("environment variable %q", name))
+	b.appendDefs("export " + name + "=" + shellquote(value))
+	b.env = append(b.env, name+"="+value)
+}
+
+// shellquote returns the specified string single-quoted for safe use in
+// shell scripts.
+func shellquote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
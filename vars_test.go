@@ -0,0 +1,81 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy
+// of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package testbasher
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Basher variables", func() {
+
+	It("passes variables intact into scripts", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Var("s", `/some path/with "quotes" and 'more' $quotes`)
+		b.Var("i", -42)
+		b.Var("u", uint8(42))
+		b.Var("a", []string{"a b", "'c'", "$d"})
+		b.Var("m", map[string]string{"a b": "'c'", "$d": `"e"`})
+		b.Script("script", `
+j() { for s in "$@"; do s=${s//\\/\\\\}; printf '"%s"\n' "${s//\"/\\\"}"; done; }
+j "$s" "$i" "$u" "${#a[@]}" "${a[@]}" "${#m[@]}" "${m['a b']}" "${m['$d']}"
+read`)
+		cmd := b.Start("script")
+		defer cmd.Close()
+
+		var s []string
+		for range 10 {
+			var v string
+			cmd.Decode(&v)
+			s = append(s, v)
+		}
+		Expect(s).To(HaveExactElements(
+			`/some path/with "quotes" and 'more' $quotes`,
+			"-42", "42",
+			"3", "a b", "'c'", "$d",
+			"2", "'c'", `"e"`))
+	})
+
+	It("exports environment variables", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Env("FOO", "it's a bar")
+		b.Script("script", `sh -c 'printf "\"%s\"\n" "$FOO"' && read`)
+		cmd := b.Start("script")
+		defer cmd.Close()
+
+		var s string
+		cmd.Decode(&s)
+		Expect(s).To(Equal("it's a bar"))
+		Expect(cmd.cmd.Env).To(ContainElement("FOO=it's a bar"))
+	})
+
+	It("rejects invalid and clashing variables", func() {
+		b := Basher{}
+		defer b.Done()
+
+		b.Script("foo", "")
+		Expect(func() { b.Var("foo", "") }).To(PanicWith(MatchError(
+			`Basher: variable "foo" clashes with script "foo" on variable "foo"`)))
+		Expect(func() { b.Env("IFS", "") }).To(PanicWith(MatchError(
+			MatchRegexp(`"IFS" is a reserved shell variable`))))
+		Expect(func() { b.Var("bar", 4.2) }).To(PanicWith(MatchError(
+			`Basher: unsupported type float64 of variable "bar"`)))
+	})
+
+})